@@ -3,6 +3,8 @@ import Layout from './components/Layout';
 import AuthPage from './pages/AuthPage';
 import DashboardPage from './pages/DashboardPage';
 import RulesPage from './pages/RulesPage';
+import LogsPage from './pages/LogsPage';
+import BackfillPage from './pages/BackfillPage';
 
 export default function App() {
   return (
@@ -12,6 +14,8 @@ export default function App() {
         <Route element={<Layout />}>
           <Route path="/" element={<DashboardPage />} />
           <Route path="/rules" element={<RulesPage />} />
+          <Route path="/logs" element={<LogsPage />} />
+          <Route path="/backfill" element={<BackfillPage />} />
         </Route>
       </Routes>
     </BrowserRouter>
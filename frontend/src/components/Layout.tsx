@@ -3,6 +3,8 @@ import { NavLink, Outlet } from 'react-router-dom';
 const navItems = [
   { to: '/', label: '仪表盘' },
   { to: '/rules', label: '转发规则' },
+  { to: '/logs', label: '转发记录' },
+  { to: '/backfill', label: '回填任务' },
 ];
 
 export default function Layout() {
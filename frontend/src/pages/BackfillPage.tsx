@@ -0,0 +1,246 @@
+import { useCallback, useEffect, useState } from 'react';
+import { useSearchParams } from 'react-router-dom';
+import { rpc } from '../lib/rpc';
+
+type BackfillJob = {
+  id: number;
+  rule_id: number;
+  limit: number;
+  since: string | null;
+  until: string | null;
+  from_message_id: number;
+  status: string;
+  cursor: number;
+  scanned: number;
+  matched: number;
+  queued: number;
+  forwarded: number;
+  error: string;
+  created_at: string;
+  updated_at: string;
+  finished_at: string | null;
+};
+
+const statusLabel: Record<string, string> = {
+  running: '进行中',
+  done: '已完成',
+  failed: '失败',
+  cancelled: '已取消',
+};
+
+const statusClass: Record<string, string> = {
+  running: 'text-blue-700',
+  done: 'text-green-700',
+  failed: 'text-red-700',
+  cancelled: 'text-gray-500',
+};
+
+// Converts a datetime-local input value to RFC 3339
+const toRFC3339 = (value: string) => (value ? new Date(value).toISOString() : undefined);
+
+export default function BackfillPage() {
+  const [searchParams] = useSearchParams();
+  const [jobs, setJobs] = useState<BackfillJob[]>([]);
+  const [loading, setLoading] = useState(true);
+  const [error, setError] = useState('');
+
+  const [ruleId, setRuleId] = useState(searchParams.get('rule_id') ?? '');
+  const [limit, setLimit] = useState('');
+  const [since, setSince] = useState('');
+  const [until, setUntil] = useState('');
+  const [fromMessageId, setFromMessageId] = useState('');
+
+  const loadJobs = useCallback(async () => {
+    try {
+      setJobs((await rpc<BackfillJob[]>('backfill.list', { limit: 100 })) ?? []);
+      setError('');
+    } catch (e: unknown) {
+      setError(e instanceof Error ? e.message : '加载回填任务失败');
+    } finally {
+      setLoading(false);
+    }
+  }, []);
+
+  useEffect(() => { loadJobs(); }, [loadJobs]);
+
+  // Poll while jobs are running
+  const running = jobs.some((j) => j.status === 'running');
+  useEffect(() => {
+    if (!running) return;
+    const timer = setInterval(loadJobs, 3000);
+    return () => clearInterval(timer);
+  }, [running, loadJobs]);
+
+  const handleStart = async () => {
+    setError('');
+    if (!ruleId) {
+      setError('请填写规则 ID');
+      return;
+    }
+    try {
+      await rpc('rules.backfill', {
+        id: Number(ruleId),
+        limit: Number(limit || 0),
+        since: toRFC3339(since),
+        until: toRFC3339(until),
+        from_message_id: Number(fromMessageId || 0),
+      });
+      setLimit('');
+      setSince('');
+      setUntil('');
+      setFromMessageId('');
+      await loadJobs();
+    } catch (e: unknown) {
+      setError(e instanceof Error ? e.message : '启动回填失败');
+    }
+  };
+
+  const handleCancel = async (id: number) => {
+    if (!confirm('确定取消该回填任务？尚未发送的消息也会被取消。')) return;
+    try {
+      await rpc('backfill.cancel', { id });
+      await loadJobs();
+    } catch (e: unknown) {
+      setError(e instanceof Error ? e.message : '取消回填失败');
+    }
+  };
+
+  return (
+    <div>
+      <div className="flex items-center justify-between mb-6">
+        <h2 className="text-xl font-bold text-gray-800">回填任务</h2>
+        <button
+          onClick={loadJobs}
+          className="px-4 py-2 bg-blue-600 text-white rounded-md hover:bg-blue-700 text-sm"
+        >
+          刷新
+        </button>
+      </div>
+
+      {error && (
+        <div className="mb-4 p-3 bg-red-50 text-red-700 rounded text-sm">{error}</div>
+      )}
+
+      <div className="bg-white rounded-lg shadow p-6 mb-6">
+        <h3 className="text-lg font-semibold mb-4">新建回填</h3>
+        <div className="grid grid-cols-1 md:grid-cols-5 gap-4">
+          <div>
+            <label className="block text-sm font-medium text-gray-700 mb-1">规则 ID</label>
+            <input
+              type="number"
+              min="1"
+              value={ruleId}
+              onChange={(e) => setRuleId(e.target.value)}
+              className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+            />
+          </div>
+          <div>
+            <label className="block text-sm font-medium text-gray-700 mb-1">扫描条数</label>
+            <input
+              type="number"
+              min="0"
+              value={limit}
+              onChange={(e) => setLimit(e.target.value)}
+              placeholder="默认 50"
+              className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+            />
+          </div>
+          <div>
+            <label className="block text-sm font-medium text-gray-700 mb-1">开始时间</label>
+            <input
+              type="datetime-local"
+              value={since}
+              onChange={(e) => setSince(e.target.value)}
+              className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+            />
+          </div>
+          <div>
+            <label className="block text-sm font-medium text-gray-700 mb-1">结束时间</label>
+            <input
+              type="datetime-local"
+              value={until}
+              onChange={(e) => setUntil(e.target.value)}
+              className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+            />
+          </div>
+          <div>
+            <label className="block text-sm font-medium text-gray-700 mb-1">起始消息 ID</label>
+            <input
+              type="number"
+              min="0"
+              value={fromMessageId}
+              onChange={(e) => setFromMessageId(e.target.value)}
+              className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+            />
+          </div>
+        </div>
+        <p className="mt-2 text-xs text-gray-400">
+          从最新消息往前扫描，匹配的消息按规则的限速排队发送。指定开始时间或起始消息 ID 且不填条数时，最多扫描 10000 条。
+        </p>
+        <button
+          onClick={handleStart}
+          className="mt-4 px-4 py-2 bg-blue-600 text-white rounded-md hover:bg-blue-700 text-sm"
+        >
+          开始回填
+        </button>
+      </div>
+
+      <div className="bg-white rounded-lg shadow">
+        <table className="w-full">
+          <thead>
+            <tr className="border-b text-left text-sm text-gray-500">
+              <th className="px-4 py-3">ID</th>
+              <th className="px-4 py-3">规则</th>
+              <th className="px-4 py-3">进度</th>
+              <th className="px-4 py-3">匹配 / 排队 / 已发送</th>
+              <th className="px-4 py-3">状态</th>
+              <th className="px-4 py-3">创建时间</th>
+              <th className="px-4 py-3">操作</th>
+            </tr>
+          </thead>
+          <tbody className="divide-y">
+            {jobs.map((j) => {
+              const percent = j.status === 'done' ? 100 : Math.min(100, Math.round((j.scanned / Math.max(j.limit, 1)) * 100));
+              return (
+                <tr key={j.id}>
+                  <td className="px-4 py-3 text-sm">{j.id}</td>
+                  <td className="px-4 py-3 text-sm">#{j.rule_id}</td>
+                  <td className="px-4 py-3 text-sm">
+                    <div className="w-40 h-2 bg-gray-100 rounded">
+                      <div className="h-2 bg-blue-500 rounded" style={{ width: `${percent}%` }} />
+                    </div>
+                    <div className="mt-1 text-xs text-gray-400">
+                      已扫描 {j.scanned} / {j.limit} 条{j.cursor ? `，当前消息 ${j.cursor}` : ''}
+                    </div>
+                  </td>
+                  <td className="px-4 py-3 text-sm">{j.matched} / {j.queued} / {j.forwarded}</td>
+                  <td className="px-4 py-3 text-sm">
+                    <span className={statusClass[j.status] ?? ''}>{statusLabel[j.status] ?? j.status}</span>
+                    {j.error && <div className="text-xs text-gray-400">{j.error}</div>}
+                  </td>
+                  <td className="px-4 py-3 text-sm text-gray-500">{new Date(j.created_at).toLocaleString()}</td>
+                  <td className="px-4 py-3">
+                    {/* Finished jobs can still drop their queued deliveries */}
+                    {(j.status === 'running' || (j.status !== 'cancelled' && j.forwarded < j.queued)) && (
+                      <button
+                        onClick={() => handleCancel(j.id)}
+                        className="text-xs text-red-600 hover:underline"
+                      >
+                        取消
+                      </button>
+                    )}
+                  </td>
+                </tr>
+              );
+            })}
+            {!loading && jobs.length === 0 && (
+              <tr>
+                <td colSpan={7} className="px-4 py-8 text-center text-gray-400">暂无回填任务</td>
+              </tr>
+            )}
+          </tbody>
+        </table>
+      </div>
+    </div>
+  );
+}
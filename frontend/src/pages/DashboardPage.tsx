@@ -28,6 +28,7 @@ const typeBadge: Record<string, string> = {
 const typeLabel: Record<string, string> = {
   user: '私聊',
   group: '群聊',
+  supergroup: '超级群',
   channel: '频道',
 };
 
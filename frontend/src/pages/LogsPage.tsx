@@ -0,0 +1,109 @@
+import { useCallback, useEffect, useState } from 'react';
+import { rpc } from '../lib/rpc';
+
+type ForwardLog = {
+  id: number;
+  rule_id: number;
+  target_id: number;
+  message_id: number;
+  source_channel_id: number;
+  target_channel_id: number;
+  sender_id: number;
+  sender_name: string;
+  status: string;
+  error: string;
+  created_at: string;
+};
+
+const statusLabel: Record<string, string> = {
+  sent: '已发送',
+  failed: '失败',
+  skipped: '已跳过',
+};
+
+export default function LogsPage() {
+  const [logs, setLogs] = useState<ForwardLog[]>([]);
+  const [ruleId, setRuleId] = useState('');
+  const [loading, setLoading] = useState(true);
+  const [error, setError] = useState('');
+
+  const loadLogs = useCallback(async () => {
+    setLoading(true);
+    try {
+      const params = ruleId ? { rule_id: Number(ruleId), limit: 200 } : { limit: 200 };
+      setLogs((await rpc<ForwardLog[]>('logs.list', params)) ?? []);
+      setError('');
+    } catch (e: unknown) {
+      setError(e instanceof Error ? e.message : '加载记录失败');
+    } finally {
+      setLoading(false);
+    }
+  }, [ruleId]);
+
+  useEffect(() => { loadLogs(); }, [loadLogs]);
+
+  return (
+    <div>
+      <div className="flex items-center justify-between mb-6">
+        <h2 className="text-xl font-bold text-gray-800">转发记录</h2>
+        <div className="flex items-center gap-2">
+          <input
+            type="number"
+            min="1"
+            value={ruleId}
+            onChange={(e) => setRuleId(e.target.value)}
+            placeholder="规则 ID"
+            className="w-28 px-3 py-2 border rounded-md text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+          />
+          <button
+            onClick={loadLogs}
+            className="px-4 py-2 bg-blue-600 text-white rounded-md hover:bg-blue-700 text-sm"
+          >
+            刷新
+          </button>
+        </div>
+      </div>
+
+      {error && (
+        <div className="mb-4 p-3 bg-red-50 text-red-700 rounded text-sm">{error}</div>
+      )}
+
+      <div className="bg-white rounded-lg shadow">
+        <table className="w-full">
+          <thead>
+            <tr className="border-b text-left text-sm text-gray-500">
+              <th className="px-4 py-3">时间</th>
+              <th className="px-4 py-3">规则</th>
+              <th className="px-4 py-3">消息</th>
+              <th className="px-4 py-3">发送者</th>
+              <th className="px-4 py-3">目标</th>
+              <th className="px-4 py-3">状态</th>
+            </tr>
+          </thead>
+          <tbody className="divide-y">
+            {logs.map((l) => (
+              <tr key={l.id}>
+                <td className="px-4 py-3 text-sm text-gray-500">{new Date(l.created_at).toLocaleString()}</td>
+                <td className="px-4 py-3 text-sm">#{l.rule_id}</td>
+                <td className="px-4 py-3 text-sm font-mono text-xs">{l.message_id}</td>
+                <td className="px-4 py-3 text-sm">{l.sender_name || l.sender_id || '-'}</td>
+                <td className="px-4 py-3 text-sm">{l.target_channel_id}</td>
+                <td className="px-4 py-3 text-sm">
+                  <span className={l.status === 'sent' ? 'text-green-700' : 'text-red-700'}>
+                    {statusLabel[l.status] ?? l.status}
+                  </span>
+                  {l.error && <div className="text-xs text-gray-400">{l.error}</div>}
+                </td>
+              </tr>
+            ))}
+            {!loading && logs.length === 0 && (
+              <tr>
+                <td colSpan={6} className="px-4 py-8 text-center text-gray-400">暂无记录</td>
+              </tr>
+            )}
+          </tbody>
+        </table>
+      </div>
+    </div>
+  );
+}
@@ -1,31 +1,239 @@
 import { useState, useEffect, useCallback } from 'react';
+import { Link } from 'react-router-dom';
 import { rpc } from '../lib/rpc';
 
+type DeliveryMode = 'forward' | 'copy' | 'digest';
+
+type TextReplacement = {
+  pattern: string;
+  replacement: string;
+};
+
+type DigestConfig = {
+  interval: number;
+  at: string[] | null;
+  title: string;
+  max_items: number;
+};
+
+type ForwardTarget = {
+  id: number;
+  target_channel_id: number;
+  target_type: string;
+  target_name: string;
+  target_hash: string;
+  topic_id: number;
+  webhook_url: string;
+  has_webhook_secret: boolean; // the secret itself is never returned
+  dedup_hours: number;
+  rate_limit: number;
+  rate_period: number;
+  rate_burst: number;
+};
+
 type ForwardRule = {
   id: number;
   source_channel_id: number;
+  source_type: string;
   source_name: string;
   source_hash: string;
-  target_channel_id: number;
-  target_name: string;
-  target_hash: string;
+  source_topic_ids: number[] | null;
+  targets: ForwardTarget[] | null;
   match_pattern: string;
+  conditions: RuleConditions | null;
+  senders: SenderFilter | null;
+  delivery_mode: DeliveryMode;
+  replacements: TextReplacement[] | null;
+  prefix_template: string;
+  suffix_template: string;
+  media_types: string[] | null;
+  mime_types: string[] | null;
+  file_name_pattern: string;
+  min_size: number;
+  max_size: number;
+  rate_limit: number;
+  rate_period: number;
+  rate_burst: number;
+  forward_edits: boolean;
+  sync_deletes: boolean;
   enabled: boolean;
+  schedule: RuleSchedule | null;
+  digest: DigestConfig | null;
+  active_now: boolean;
   created_at: string;
   updated_at: string;
 };
 
+type RuleConditions = {
+  all: string[] | null;
+  any: string[] | null;
+  none: string[] | null;
+  keywords: string[] | null;
+  exclude_keywords: string[] | null;
+  ignore_case: boolean;
+  whole_word: boolean;
+};
+
+// Editable form of RuleConditions: regexes one per line, keywords comma-separated
+type ConditionsForm = {
+  all: string;
+  any: string;
+  none: string;
+  keywords: string;
+  exclude_keywords: string;
+  ignore_case: boolean;
+  whole_word: boolean;
+};
+
+const emptyConditions: ConditionsForm = {
+  all: '', any: '', none: '', keywords: '', exclude_keywords: '', ignore_case: false, whole_word: false,
+};
+
+const splitLines = (s: string) => s.split('\n').map((x) => x.trim()).filter(Boolean);
+const splitList = (s: string) => s.split(/[,，\n]/).map((x) => x.trim()).filter(Boolean);
+
+type SenderFilter = {
+  allow_ids: number[] | null;
+  allow_usernames: string[] | null;
+  allow_authors: string[] | null;
+  deny_ids: number[] | null;
+  deny_usernames: string[] | null;
+  deny_authors: string[] | null;
+  deny_bots: boolean;
+};
+
+// Sender lists are edited as one comma-separated list: numeric IDs,
+// @usernames and post signatures
+const parseSenders = (s: string) => {
+  const items = splitList(s);
+  return {
+    ids: items.filter((x) => /^-?\d+$/.test(x)).map(Number),
+    usernames: items.filter((x) => x.startsWith('@')).map((x) => x.slice(1)),
+    authors: items.filter((x) => !/^-?\d+$/.test(x) && !x.startsWith('@')),
+  };
+};
+
+const formatSenders = (ids: number[] | null, usernames: string[] | null, authors: string[] | null) =>
+  [...(ids ?? []).map(String), ...(usernames ?? []).map((u) => `@${u}`), ...(authors ?? [])].join(', ');
+
+type ScheduleWindow = {
+  days: number[] | null;
+  start: string;
+  end: string;
+};
+
+type RuleSchedule = {
+  timezone: string;
+  windows: ScheduleWindow[] | null;
+  blackouts: string[] | null;
+  outside: 'drop' | 'hold' | '';
+};
+
+const weekdayLabel = ['日', '一', '二', '三', '四', '五', '六'];
+
 type ChannelInfo = {
   id: number;
   name: string;
   type: string;
   access_hash: string;
+  forum?: boolean;
+};
+
+type TopicInfo = {
+  id: number;
+  title: string;
+  closed: boolean;
+  hidden: boolean;
+};
+
+type TestMessage = {
+  message_id?: number;
+  date?: string;
+  text: string;
+  sender_name?: string;
+  matched: boolean;
+  groups?: Record<string, string>;
+  rules: number[];
+};
+
+type TestResult = {
+  scanned: number;
+  matched: number;
+  messages: TestMessage[] | null;
+};
+
+type SimulationDay = {
+  date?: string;
+  scanned: number;
+  matched: number;
+  outside_schedule: number;
+  delivered: number;
+  rate_limited: number;
+  held: number;
+  duplicates: number;
 };
 
+type SimulationSample = {
+  message_id: number;
+  date: string;
+  text: string;
+  target?: string;
+  outcome: string;
+  delay: number;
+};
+
+type SimulationResult = {
+  since: string;
+  scanned: number;
+  truncated: boolean;
+  total: SimulationDay;
+  days: SimulationDay[] | null;
+  matches: SimulationSample[] | null;
+  rate_limited: SimulationSample[] | null;
+};
+
+const outcomeLabel: Record<string, string> = {
+  delivered: '投递',
+  rate_limited: '限速延迟',
+  held: '等待发送',
+  duplicate: '去重跳过',
+  outside_schedule: '时段外丢弃',
+};
+
+const formatDelay = (s: number) =>
+  s < 60 ? `${s} 秒` : s < 3600 ? `${Math.round(s / 60)} 分钟` : `${(s / 3600).toFixed(1)} 小时`;
+
 const typeLabel: Record<string, string> = {
   channel: '频道',
+  supergroup: '超级群',
   group: '群聊',
   user: '私聊',
+  self: '收藏夹',
+};
+
+// Chat IDs are only unique per peer type; supergroups are channels in the API
+const peerKey = (type: string, id: number) => `${type === 'supergroup' ? 'channel' : type}:${id}`;
+
+const savedMessages: ChannelInfo = { id: 0, name: '收藏夹 (Saved Messages)', type: 'self', access_hash: '0' };
+
+const mediaTypeLabel: Record<string, string> = {
+  text: '纯文本',
+  photo: '图片',
+  video: '视频',
+  animation: 'GIF',
+  audio: '音频',
+  voice: '语音',
+  sticker: '贴纸',
+  document: '文件',
+  other: '其他',
+};
+
+const MB = 1024 * 1024;
+
+const modeLabel: Record<DeliveryMode, string> = {
+  forward: '转发',
+  copy: '复制',
+  digest: '摘要',
 };
 
 export default function RulesPage() {
@@ -35,16 +243,53 @@ export default function RulesPage() {
   const [showForm, setShowForm] = useState(false);
   const [editingRule, setEditingRule] = useState<ForwardRule | null>(null);
   const [error, setError] = useState('');
+  const [testText, setTestText] = useState('');
+  const [testResult, setTestResult] = useState<TestResult | null>(null);
+  const [testing, setTesting] = useState(false);
+  const [simDays, setSimDays] = useState('7');
+  const [simResult, setSimResult] = useState<SimulationResult | null>(null);
+  const [simulating, setSimulating] = useState(false);
 
   const [sourceId, setSourceId] = useState('');
-  const [targetId, setTargetId] = useState('');
+  const [targetIds, setTargetIds] = useState<string[]>([]);
+  const [sourceTopics, setSourceTopics] = useState<number[]>([]);
+  const [targetTopics, setTargetTopics] = useState<Record<string, number>>({});
+  const [webhooks, setWebhooks] = useState<{ url: string; secret: string }[]>([]);
+  const [topics, setTopics] = useState<Record<string, TopicInfo[]>>({});
   const [matchPattern, setMatchPattern] = useState('');
+  const [conditions, setConditions] = useState<ConditionsForm>(emptyConditions);
+  const [allowSenders, setAllowSenders] = useState('');
+  const [denySenders, setDenySenders] = useState('');
+  const [denyBots, setDenyBots] = useState(false);
+  const [timezone, setTimezone] = useState('');
+  const [windows, setWindows] = useState<ScheduleWindow[]>([]);
+  const [blackouts, setBlackouts] = useState('');
+  const [holdOutside, setHoldOutside] = useState(false);
+  const [deliveryMode, setDeliveryMode] = useState<DeliveryMode>('forward');
+  const [replacements, setReplacements] = useState<TextReplacement[]>([]);
+  const [prefixTemplate, setPrefixTemplate] = useState('');
+  const [suffixTemplate, setSuffixTemplate] = useState('');
+  const [mediaTypes, setMediaTypes] = useState<string[]>([]);
+  const [mimeTypes, setMimeTypes] = useState('');
+  const [fileNamePattern, setFileNamePattern] = useState('');
+  const [minSizeMB, setMinSizeMB] = useState('');
+  const [maxSizeMB, setMaxSizeMB] = useState('');
+  const [rateLimit, setRateLimit] = useState('1');
+  const [ratePeriod, setRatePeriod] = useState('60');
+  const [rateBurst, setRateBurst] = useState('1');
+  const [dedupHours, setDedupHours] = useState('');
+  const [forwardEdits, setForwardEdits] = useState(false);
+  const [syncDeletes, setSyncDeletes] = useState(false);
+  const [digestInterval, setDigestInterval] = useState('60');
+  const [digestAt, setDigestAt] = useState('');
+  const [digestTitle, setDigestTitle] = useState('');
+  const [digestMaxItems, setDigestMaxItems] = useState('');
 
   const loadData = useCallback(async () => {
     try {
       const [r, c] = await Promise.all([
         rpc<ForwardRule[]>('rules.list'),
-        rpc<ChannelInfo[]>('channels.list'),
+        rpc<ChannelInfo[]>('dialogs.list', { limit: 100 }),
       ]);
       setRules(r ?? []);
       setChannels(c ?? []);
@@ -57,10 +302,58 @@ export default function RulesPage() {
 
   useEffect(() => { loadData(); }, [loadData]);
 
+  // Load the topics of selected forums once
+  useEffect(() => {
+    const forums = channels.filter((c) => c.forum && !(peerKey(c.type, c.id) in topics) &&
+      (peerKey(c.type, c.id) === sourceId || targetIds.includes(peerKey(c.type, c.id))));
+    forums.forEach(async (c) => {
+      const key = peerKey(c.type, c.id);
+      try {
+        const list = await rpc<TopicInfo[]>('topics.list', { channel_id: c.id, access_hash: c.access_hash });
+        setTopics((prev) => ({ ...prev, [key]: list ?? [] }));
+      } catch {
+        setTopics((prev) => ({ ...prev, [key]: [] }));
+      }
+    });
+  }, [channels, sourceId, targetIds, topics]);
+
   const resetForm = () => {
     setSourceId('');
-    setTargetId('');
+    setTargetIds([]);
+    setSourceTopics([]);
+    setTargetTopics({});
+    setWebhooks([]);
     setMatchPattern('');
+    setConditions(emptyConditions);
+    setAllowSenders('');
+    setDenySenders('');
+    setDenyBots(false);
+    setTimezone('');
+    setWindows([]);
+    setBlackouts('');
+    setHoldOutside(false);
+    setDeliveryMode('forward');
+    setReplacements([]);
+    setPrefixTemplate('');
+    setSuffixTemplate('');
+    setMediaTypes([]);
+    setMimeTypes('');
+    setFileNamePattern('');
+    setMinSizeMB('');
+    setMaxSizeMB('');
+    setRateLimit('1');
+    setRatePeriod('60');
+    setRateBurst('1');
+    setDedupHours('');
+    setForwardEdits(false);
+    setSyncDeletes(false);
+    setDigestInterval('60');
+    setDigestAt('');
+    setDigestTitle('');
+    setDigestMaxItems('');
+    setTestText('');
+    setTestResult(null);
+    setSimResult(null);
     setEditingRule(null);
     setShowForm(false);
     setError('');
@@ -68,44 +361,203 @@ export default function RulesPage() {
 
   const openEdit = (rule: ForwardRule) => {
     setEditingRule(rule);
-    setSourceId(String(rule.source_channel_id));
-    setTargetId(String(rule.target_channel_id));
+    setSourceId(peerKey(rule.source_type ?? 'channel', rule.source_channel_id));
+    setTargetIds((rule.targets ?? [])
+      .filter((t) => t.target_type !== 'webhook')
+      .map((t) => peerKey(t.target_type ?? 'channel', t.target_channel_id)));
+    setWebhooks((rule.targets ?? [])
+      .filter((t) => t.target_type === 'webhook')
+      .map((t) => ({ url: t.webhook_url, secret: '' })));
+    setSourceTopics(rule.source_topic_ids ?? []);
+    setTargetTopics(Object.fromEntries((rule.targets ?? [])
+      .filter((t) => t.topic_id)
+      .map((t) => [peerKey(t.target_type ?? 'channel', t.target_channel_id), t.topic_id])));
     setMatchPattern(rule.match_pattern);
+    setConditions({
+      all: (rule.conditions?.all ?? []).join('\n'),
+      any: (rule.conditions?.any ?? []).join('\n'),
+      none: (rule.conditions?.none ?? []).join('\n'),
+      keywords: (rule.conditions?.keywords ?? []).join(', '),
+      exclude_keywords: (rule.conditions?.exclude_keywords ?? []).join(', '),
+      ignore_case: rule.conditions?.ignore_case ?? false,
+      whole_word: rule.conditions?.whole_word ?? false,
+    });
+    const f = rule.senders;
+    setAllowSenders(formatSenders(f?.allow_ids ?? null, f?.allow_usernames ?? null, f?.allow_authors ?? null));
+    setDenySenders(formatSenders(f?.deny_ids ?? null, f?.deny_usernames ?? null, f?.deny_authors ?? null));
+    setDenyBots(f?.deny_bots ?? false);
+    setTimezone(rule.schedule?.timezone ?? '');
+    setWindows(rule.schedule?.windows ?? []);
+    setBlackouts((rule.schedule?.blackouts ?? []).join(', '));
+    setHoldOutside(rule.schedule?.outside === 'hold');
+    setDeliveryMode(rule.delivery_mode ?? 'forward');
+    setReplacements(rule.replacements ?? []);
+    setPrefixTemplate(rule.prefix_template ?? '');
+    setSuffixTemplate(rule.suffix_template ?? '');
+    setMediaTypes(rule.media_types ?? []);
+    setMimeTypes((rule.mime_types ?? []).join(', '));
+    setFileNamePattern(rule.file_name_pattern ?? '');
+    setMinSizeMB(rule.min_size ? String(rule.min_size / MB) : '');
+    setMaxSizeMB(rule.max_size ? String(rule.max_size / MB) : '');
+    setRateLimit(String(rule.rate_limit ?? 0));
+    setRatePeriod(String(rule.rate_period ?? 60));
+    setRateBurst(String(rule.rate_burst ?? 1));
+    const dedup = Math.max(0, ...(rule.targets ?? []).map((t) => t.dedup_hours ?? 0));
+    setDedupHours(dedup ? String(dedup) : '');
+    setForwardEdits(rule.forward_edits ?? false);
+    setSyncDeletes(rule.sync_deletes ?? false);
+    setDigestInterval(rule.digest?.interval ? String(rule.digest.interval) : '');
+    setDigestAt((rule.digest?.at ?? []).join(', '));
+    setDigestTitle(rule.digest?.title ?? '');
+    setDigestMaxItems(rule.digest?.max_items ? String(rule.digest.max_items) : '');
     setShowForm(true);
   };
 
-  const handleSubmit = async () => {
-    setError('');
-    const source = channels.find((c) => String(c.id) === sourceId);
-    const target = channels.find((c) => String(c.id) === targetId);
+  // Matching options shared by saving and testing a rule
+  const matchOptions = () => {
+    const ruleConditions: RuleConditions = {
+      all: splitLines(conditions.all),
+      any: splitLines(conditions.any),
+      none: splitLines(conditions.none),
+      keywords: splitList(conditions.keywords),
+      exclude_keywords: splitList(conditions.exclude_keywords),
+      ignore_case: conditions.ignore_case,
+      whole_word: conditions.whole_word,
+    };
+    const hasConditions = [
+      ruleConditions.all, ruleConditions.any, ruleConditions.none,
+      ruleConditions.keywords, ruleConditions.exclude_keywords,
+    ].some((l) => (l ?? []).length > 0);
 
-    if (!source || !target || !matchPattern) {
-      setError('请填写所有字段');
-      return;
+    const allow = parseSenders(allowSenders);
+    const deny = parseSenders(denySenders);
+    const senders: SenderFilter = {
+      allow_ids: allow.ids,
+      allow_usernames: allow.usernames,
+      allow_authors: allow.authors,
+      deny_ids: deny.ids,
+      deny_usernames: deny.usernames,
+      deny_authors: deny.authors,
+      deny_bots: denyBots,
+    };
+
+    const mediaFilters = {
+      media_types: mediaTypes,
+      mime_types: mimeTypes.split(',').map((t) => t.trim()).filter(Boolean),
+      file_name_pattern: fileNamePattern,
+      min_size: Math.round(Number(minSizeMB || 0) * MB),
+      max_size: Math.round(Number(maxSizeMB || 0) * MB),
+    };
+
+    return {
+      hasConditions,
+      match_pattern: matchPattern,
+      conditions: ruleConditions,
+      senders,
+      ...mediaFilters,
+    };
+  };
+
+  // Webhook secrets are write-only: an empty secret keeps the stored one
+  const hasStoredSecret = (url: string) => !!editingRule?.targets?.some((t) =>
+    t.target_type === 'webhook' && t.webhook_url === url.trim() && t.has_webhook_secret);
+
+  // Builds the rules.create/update params from the form, or returns null
+  // after showing what is missing
+  const buildPayload = () => {
+    const source = channels.find((c) => peerKey(c.type, c.id) === sourceId);
+    const targets = [savedMessages, ...channels].filter((c) => targetIds.includes(peerKey(c.type, c.id)));
+    const { hasConditions, ...match } = matchOptions();
+
+    const hooks = webhooks.filter((w) => w.url.trim());
+    if (!source || targets.length + hooks.length === 0 || (!matchPattern && !hasConditions)) {
+      setError('请选择来源和目标，并填写匹配规则或条件');
+      return null;
     }
 
+    // Text transforms only apply to copies
+    const transforms = deliveryMode === 'copy'
+      ? {
+          replacements: replacements.filter((r) => r.pattern),
+          prefix_template: prefixTemplate,
+          suffix_template: suffixTemplate,
+        }
+      : { replacements: [], prefix_template: '', suffix_template: '' };
+
+    return {
+      source_channel_id: source.id,
+      source_type: source.type,
+      source_name: source.name,
+      source_hash: source.access_hash,
+      source_topic_ids: source.forum ? sourceTopics : [],
+      targets: targets.map((t) => {
+        // Keep per-target rate limits, which are only editable via RPC
+        const existing = editingRule?.targets?.find((x) => peerKey(x.target_type, x.target_channel_id) === peerKey(t.type, t.id));
+        return {
+          target_channel_id: t.id,
+          target_type: t.type,
+          target_name: t.name,
+          target_hash: t.access_hash,
+          topic_id: t.forum ? targetTopics[peerKey(t.type, t.id)] ?? 0 : 0,
+          webhook_url: '',
+          webhook_secret: '',
+          dedup_hours: Number(dedupHours || 0),
+          rate_limit: existing?.rate_limit ?? 0,
+          rate_period: existing?.rate_period ?? 0,
+          rate_burst: existing?.rate_burst ?? 0,
+        };
+      }).concat(hooks.map((w) => {
+        const url = w.url.trim();
+        const existing = editingRule?.targets?.find((x) => x.target_type === 'webhook' && x.webhook_url === url);
+        return {
+          target_channel_id: 0,
+          target_type: 'webhook',
+          target_name: url,
+          target_hash: '0',
+          topic_id: 0,
+          webhook_url: url,
+          webhook_secret: w.secret,
+          dedup_hours: Number(dedupHours || 0),
+          rate_limit: existing?.rate_limit ?? 0,
+          rate_period: existing?.rate_period ?? 0,
+          rate_burst: existing?.rate_burst ?? 0,
+        };
+      })),
+      ...match,
+      schedule: {
+        timezone,
+        windows,
+        blackouts: splitList(blackouts),
+        outside: holdOutside ? 'hold' : 'drop',
+      },
+      delivery_mode: deliveryMode,
+      ...transforms,
+      rate_limit: Number(rateLimit || 0),
+      rate_period: Number(ratePeriod || 0),
+      rate_burst: Number(rateBurst || 0),
+      digest: deliveryMode === 'digest'
+        ? {
+            interval: Number(digestInterval || 0),
+            at: splitList(digestAt),
+            title: digestTitle,
+            max_items: Number(digestMaxItems || 0),
+          }
+        : { interval: 0, at: [], title: '', max_items: 0 },
+      forward_edits: deliveryMode === 'forward' && forwardEdits,
+      sync_deletes: syncDeletes,
+    };
+  };
+
+  const handleSubmit = async () => {
+    setError('');
+    const payload = buildPayload();
+    if (!payload) return;
+
     try {
       if (editingRule) {
-        await rpc('rules.update', {
-          id: editingRule.id,
-          source_channel_id: source.id,
-          source_name: source.name,
-          source_hash: source.access_hash,
-          target_channel_id: target.id,
-          target_name: target.name,
-          target_hash: target.access_hash,
-          match_pattern: matchPattern,
-        });
+        await rpc('rules.update', { id: editingRule.id, ...payload });
       } else {
-        await rpc('rules.create', {
-          source_channel_id: source.id,
-          source_name: source.name,
-          source_hash: source.access_hash,
-          target_channel_id: target.id,
-          target_name: target.name,
-          target_hash: target.access_hash,
-          match_pattern: matchPattern,
-        });
+        await rpc('rules.create', payload);
       }
       resetForm();
       await loadData();
@@ -114,6 +566,51 @@ export default function RulesPage() {
     }
   };
 
+  const handleTest = async () => {
+    setError('');
+    const source = channels.find((c) => peerKey(c.type, c.id) === sourceId);
+    const { hasConditions, ...match } = matchOptions();
+    if (!matchPattern && !hasConditions) {
+      setError('请填写匹配规则或条件');
+      return;
+    }
+    if (!testText && !source) {
+      setError('请输入示例文本或选择来源');
+      return;
+    }
+
+    setTesting(true);
+    try {
+      setTestResult(await rpc<TestResult>('rules.test', {
+        ...match,
+        text: testText,
+        source_channel_id: source?.id ?? 0,
+        source_type: source?.type,
+        source_hash: source?.access_hash,
+        source_topic_ids: source?.forum ? sourceTopics : [],
+      }));
+    } catch (e: unknown) {
+      setError(e instanceof Error ? e.message : '测试规则失败');
+    } finally {
+      setTesting(false);
+    }
+  };
+
+  const handleSimulate = async () => {
+    setError('');
+    const payload = buildPayload();
+    if (!payload) return;
+
+    setSimulating(true);
+    try {
+      setSimResult(await rpc<SimulationResult>('rules.simulate', { rule: payload, days: Number(simDays || 0) }));
+    } catch (e: unknown) {
+      setError(e instanceof Error ? e.message : '模拟规则失败');
+    } finally {
+      setSimulating(false);
+    }
+  };
+
   const handleDelete = async (id: number) => {
     if (!confirm('确定删除此规则？')) return;
     try {
@@ -158,7 +655,7 @@ export default function RulesPage() {
           <h3 className="font-medium text-gray-700 mb-4">
             {editingRule ? '编辑规则' : '创建规则'}
           </h3>
-          <div className="grid grid-cols-1 md:grid-cols-3 gap-4">
+          <div className="grid grid-cols-1 md:grid-cols-4 gap-4">
             <div>
               <label className="block text-sm font-medium text-gray-700 mb-1">来源</label>
               <select
@@ -168,25 +665,94 @@ export default function RulesPage() {
               >
                 <option value="">选择来源...</option>
                 {channels.map((c) => (
-                  <option key={c.id} value={c.id}>{c.name} [{typeLabel[c.type] ?? c.type}]</option>
+                  <option key={peerKey(c.type, c.id)} value={peerKey(c.type, c.id)}>{c.name} [{typeLabel[c.type] ?? c.type}]</option>
                 ))}
               </select>
+              {(topics[sourceId] ?? []).length > 0 && (
+                <div className="mt-2">
+                  <p className="text-xs text-gray-500 mb-1">来源话题 (不选表示全部)</p>
+                  <div className="max-h-24 overflow-y-auto space-y-1">
+                    {topics[sourceId].map((t) => (
+                      <label key={t.id} className="flex items-center gap-1 text-xs text-gray-600">
+                        <input
+                          type="checkbox"
+                          checked={sourceTopics.includes(t.id)}
+                          onChange={(e) => setSourceTopics(e.target.checked
+                            ? [...sourceTopics, t.id]
+                            : sourceTopics.filter((id) => id !== t.id))}
+                        />
+                        {t.title}{t.closed ? ' (已关闭)' : ''}
+                      </label>
+                    ))}
+                  </div>
+                </div>
+              )}
             </div>
             <div>
-              <label className="block text-sm font-medium text-gray-700 mb-1">目标</label>
+              <label className="block text-sm font-medium text-gray-700 mb-1">目标 (可多选)</label>
               <select
-                value={targetId}
-                onChange={(e) => setTargetId(e.target.value)}
-                className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                multiple
+                value={targetIds}
+                onChange={(e) => setTargetIds(Array.from(e.target.selectedOptions, (o) => o.value))}
+                className="w-full h-24 px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
               >
-                <option value="">选择目标...</option>
-                {channels.map((c) => (
-                  <option key={c.id} value={c.id}>{c.name} [{typeLabel[c.type] ?? c.type}]</option>
+                {[savedMessages, ...channels].map((c) => (
+                  <option key={peerKey(c.type, c.id)} value={peerKey(c.type, c.id)}>{c.name} [{typeLabel[c.type] ?? c.type}]</option>
                 ))}
               </select>
+              {targetIds.filter((key) => (topics[key] ?? []).length > 0).map((key) => (
+                <div key={key} className="mt-2">
+                  <p className="text-xs text-gray-500 mb-1">
+                    {channels.find((c) => peerKey(c.type, c.id) === key)?.name} 的投递话题
+                  </p>
+                  <select
+                    value={targetTopics[key] ?? 0}
+                    onChange={(e) => setTargetTopics({ ...targetTopics, [key]: Number(e.target.value) })}
+                    className="w-full px-2 py-1 border rounded-md text-xs focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  >
+                    <option value={0}>默认 (General)</option>
+                    {topics[key].filter((t) => t.id !== 1).map((t) => (
+                      <option key={t.id} value={t.id}>{t.title}</option>
+                    ))}
+                  </select>
+                </div>
+              ))}
+              <p className="mt-2 text-xs text-gray-500">Webhook (以 JSON POST 推送匹配的消息)</p>
+              {webhooks.map((w, i) => (
+                <div key={i} className="flex gap-1 mt-1">
+                  <input
+                    type="text"
+                    value={w.url}
+                    onChange={(e) => setWebhooks(webhooks.map((x, j) => j === i ? { ...x, url: e.target.value } : x))}
+                    placeholder="https://example.com/hook"
+                    className="flex-1 min-w-0 px-2 py-1 border rounded-md text-xs focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                  <input
+                    type="text"
+                    value={w.secret}
+                    onChange={(e) => setWebhooks(webhooks.map((x, j) => j === i ? { ...x, secret: e.target.value } : x))}
+                    placeholder={hasStoredSecret(w.url) ? '已设置，留空不变' : '签名密钥 (可选)'}
+                    className="w-28 px-2 py-1 border rounded-md text-xs focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                  <button
+                    type="button"
+                    onClick={() => setWebhooks(webhooks.filter((_, j) => j !== i))}
+                    className="text-xs text-red-600 hover:text-red-800"
+                  >
+                    删除
+                  </button>
+                </div>
+              ))}
+              <button
+                type="button"
+                onClick={() => setWebhooks([...webhooks, { url: '', secret: '' }])}
+                className="mt-1 text-xs text-blue-600 hover:text-blue-800"
+              >
+                + 添加 Webhook
+              </button>
             </div>
             <div>
-              <label className="block text-sm font-medium text-gray-700 mb-1">匹配规则 (正则)</label>
+              <label className="block text-sm font-medium text-gray-700 mb-1">匹配规则 (正则，可与条件组合)</label>
               <input
                 type="text"
                 value={matchPattern}
@@ -195,6 +761,546 @@ export default function RulesPage() {
                 className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
               />
             </div>
+            <div>
+              <label className="block text-sm font-medium text-gray-700 mb-1">投递方式</label>
+              <select
+                value={deliveryMode}
+                onChange={(e) => setDeliveryMode(e.target.value as DeliveryMode)}
+                className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+              >
+                <option value="forward">转发 (保留来源)</option>
+                <option value="copy">复制 (无转发标记)</option>
+                <option value="digest">摘要 (定时汇总发送)</option>
+              </select>
+              {deliveryMode === 'forward' ? (
+                <label className="flex items-center gap-1 mt-1 text-xs text-gray-500">
+                  <input
+                    type="checkbox"
+                    checked={forwardEdits}
+                    onChange={(e) => setForwardEdits(e.target.checked)}
+                  />
+                  源消息编辑后重新转发
+                </label>
+              ) : deliveryMode === 'copy' && (
+                <p className="mt-1 text-xs text-gray-400">源消息编辑后同步修改副本</p>
+              )}
+              <label className="flex items-center gap-1 mt-1 text-xs text-gray-500">
+                <input
+                  type="checkbox"
+                  checked={syncDeletes}
+                  onChange={(e) => setSyncDeletes(e.target.checked)}
+                />
+                源消息删除后同步删除
+              </label>
+            </div>
+          </div>
+          <div className="mt-4 space-y-3">
+            <label className="block text-sm font-medium text-gray-700">条件 (留空的项不生效)</label>
+            <div className="grid grid-cols-1 md:grid-cols-3 gap-4">
+              {([
+                ['all', '全部满足 (正则，每行一个)'],
+                ['any', '满足任一 (正则，每行一个)'],
+                ['none', '均不满足 (正则，每行一个)'],
+              ] as const).map(([key, label]) => (
+                <div key={key}>
+                  <label className="block text-xs text-gray-500 mb-1">{label}</label>
+                  <textarea
+                    rows={3}
+                    value={conditions[key]}
+                    onChange={(e) => setConditions({ ...conditions, [key]: e.target.value })}
+                    className="w-full px-3 py-2 border rounded-md font-mono text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                </div>
+              ))}
+            </div>
+            <div className="grid grid-cols-1 md:grid-cols-2 gap-4">
+              <div>
+                <label className="block text-xs text-gray-500 mb-1">包含任一关键词 (逗号分隔)</label>
+                <input
+                  type="text"
+                  value={conditions.keywords}
+                  onChange={(e) => setConditions({ ...conditions, keywords: e.target.value })}
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+              <div>
+                <label className="block text-xs text-gray-500 mb-1">排除关键词 (逗号分隔)</label>
+                <input
+                  type="text"
+                  value={conditions.exclude_keywords}
+                  onChange={(e) => setConditions({ ...conditions, exclude_keywords: e.target.value })}
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+            </div>
+            <div className="flex gap-4 text-sm text-gray-700">
+              <label className="flex items-center gap-1">
+                <input
+                  type="checkbox"
+                  checked={conditions.ignore_case}
+                  onChange={(e) => setConditions({ ...conditions, ignore_case: e.target.checked })}
+                />
+                忽略大小写
+              </label>
+              <label className="flex items-center gap-1">
+                <input
+                  type="checkbox"
+                  checked={conditions.whole_word}
+                  onChange={(e) => setConditions({ ...conditions, whole_word: e.target.checked })}
+                />
+                关键词全词匹配
+              </label>
+            </div>
+          </div>
+          <div className="mt-4 space-y-3">
+            <label className="block text-sm font-medium text-gray-700">发送者 (ID、@用户名 或署名，逗号分隔)</label>
+            <div className="grid grid-cols-1 md:grid-cols-2 gap-4">
+              <div>
+                <label className="block text-xs text-gray-500 mb-1">仅允许 (留空则不限)</label>
+                <input
+                  type="text"
+                  value={allowSenders}
+                  onChange={(e) => setAllowSenders(e.target.value)}
+                  placeholder="123456, @alice, 编辑部"
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+              <div>
+                <label className="block text-xs text-gray-500 mb-1">排除</label>
+                <input
+                  type="text"
+                  value={denySenders}
+                  onChange={(e) => setDenySenders(e.target.value)}
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+            </div>
+            <label className="flex items-center gap-1 text-sm text-gray-700">
+              <input
+                type="checkbox"
+                checked={denyBots}
+                onChange={(e) => setDenyBots(e.target.checked)}
+              />
+              排除机器人
+            </label>
+          </div>
+          <div className="mt-4 space-y-3">
+            <div>
+              <label className="block text-sm font-medium text-gray-700 mb-1">消息类型 (不选则全部)</label>
+              <div className="flex flex-wrap gap-3">
+                {Object.entries(mediaTypeLabel).map(([type, label]) => (
+                  <label key={type} className="flex items-center gap-1 text-sm text-gray-700">
+                    <input
+                      type="checkbox"
+                      checked={mediaTypes.includes(type)}
+                      onChange={(e) => setMediaTypes(e.target.checked
+                        ? [...mediaTypes, type]
+                        : mediaTypes.filter((t) => t !== type))}
+                    />
+                    {label}
+                  </label>
+                ))}
+              </div>
+            </div>
+            <div className="grid grid-cols-1 md:grid-cols-4 gap-4">
+              <div>
+                <label className="block text-sm font-medium text-gray-700 mb-1">MIME 类型</label>
+                <input
+                  type="text"
+                  value={mimeTypes}
+                  onChange={(e) => setMimeTypes(e.target.value)}
+                  placeholder="image/*, application/pdf"
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+              <div>
+                <label className="block text-sm font-medium text-gray-700 mb-1">文件名 (正则)</label>
+                <input
+                  type="text"
+                  value={fileNamePattern}
+                  onChange={(e) => setFileNamePattern(e.target.value)}
+                  placeholder="\.pdf$"
+                  className="w-full px-3 py-2 border rounded-md font-mono text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+              <div>
+                <label className="block text-sm font-medium text-gray-700 mb-1">最小 (MB)</label>
+                <input
+                  type="number"
+                  min="0"
+                  value={minSizeMB}
+                  onChange={(e) => setMinSizeMB(e.target.value)}
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+              <div>
+                <label className="block text-sm font-medium text-gray-700 mb-1">最大 (MB)</label>
+                <input
+                  type="number"
+                  min="0"
+                  value={maxSizeMB}
+                  onChange={(e) => setMaxSizeMB(e.target.value)}
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+            </div>
+            <p className="text-xs text-gray-400">设置 MIME、文件名或大小后，仅匹配带文件的消息；图片/视频的说明文字作为匹配文本</p>
+          </div>
+          <div className="mt-4 space-y-3">
+            <label className="block text-sm font-medium text-gray-700">生效时段 (不添加则全天生效)</label>
+            {windows.map((w, i) => (
+              <div key={i} className="flex flex-wrap items-center gap-2 text-sm text-gray-700">
+                {weekdayLabel.map((label, day) => (
+                  <label key={day} className="flex items-center gap-1">
+                    <input
+                      type="checkbox"
+                      checked={(w.days ?? []).includes(day)}
+                      onChange={(e) => setWindows(windows.map((x, j) => j === i
+                        ? { ...x, days: e.target.checked ? [...(x.days ?? []), day] : (x.days ?? []).filter((d) => d !== day) }
+                        : x))}
+                    />
+                    {label}
+                  </label>
+                ))}
+                <input
+                  type="time"
+                  value={w.start}
+                  onChange={(e) => setWindows(windows.map((x, j) => j === i ? { ...x, start: e.target.value } : x))}
+                  className="px-2 py-1 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+                至
+                <input
+                  type="time"
+                  value={w.end}
+                  onChange={(e) => setWindows(windows.map((x, j) => j === i ? { ...x, end: e.target.value } : x))}
+                  className="px-2 py-1 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+                <button
+                  onClick={() => setWindows(windows.filter((_, j) => j !== i))}
+                  className="text-red-600 hover:text-red-800 text-sm"
+                >
+                  删除
+                </button>
+              </div>
+            ))}
+            <button
+              onClick={() => setWindows([...windows, { days: [1, 2, 3, 4, 5], start: '09:00', end: '18:00' }])}
+              className="text-sm text-blue-600 hover:text-blue-800"
+            >
+              + 添加时段
+            </button>
+            <p className="text-xs text-gray-400">不勾选星期表示每天；结束早于开始表示跨过午夜</p>
+            <div className="grid grid-cols-1 md:grid-cols-3 gap-4">
+              <div>
+                <label className="block text-xs text-gray-500 mb-1">时区</label>
+                <input
+                  type="text"
+                  value={timezone}
+                  onChange={(e) => setTimezone(e.target.value)}
+                  placeholder="Asia/Shanghai (默认 UTC)"
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+              <div>
+                <label className="block text-xs text-gray-500 mb-1">停用日期 (逗号分隔)</label>
+                <input
+                  type="text"
+                  value={blackouts}
+                  onChange={(e) => setBlackouts(e.target.value)}
+                  placeholder="2025-01-01, 2025-10-01"
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                />
+              </div>
+              <div>
+                <label className="block text-xs text-gray-500 mb-1">时段外的消息</label>
+                <select
+                  value={holdOutside ? 'hold' : 'drop'}
+                  onChange={(e) => setHoldOutside(e.target.value === 'hold')}
+                  className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                >
+                  <option value="drop">丢弃</option>
+                  <option value="hold">排队到时段开始</option>
+                </select>
+              </div>
+            </div>
+          </div>
+          <div className="mt-4">
+            <label className="block text-sm font-medium text-gray-700 mb-1">限速 (每个目标，超出的消息排队发送)</label>
+            <div className="flex items-center gap-2 text-sm text-gray-700">
+              <input
+                type="number"
+                min="0"
+                value={rateLimit}
+                onChange={(e) => setRateLimit(e.target.value)}
+                className="w-20 px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+              />
+              条 /
+              <input
+                type="number"
+                min="1"
+                value={ratePeriod}
+                onChange={(e) => setRatePeriod(e.target.value)}
+                className="w-20 px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+              />
+              秒，突发
+              <input
+                type="number"
+                min="1"
+                value={rateBurst}
+                onChange={(e) => setRateBurst(e.target.value)}
+                className="w-20 px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+              />
+              条
+              <span className="text-xs text-gray-400">(0 条表示不限速)</span>
+            </div>
+          </div>
+          <div className="mt-4">
+            <label className="block text-sm font-medium text-gray-700 mb-1">内容去重 (每个目标)</label>
+            <div className="flex items-center gap-2 text-sm text-gray-700">
+              跳过目标在
+              <input
+                type="number"
+                min="0"
+                value={dedupHours}
+                onChange={(e) => setDedupHours(e.target.value)}
+                placeholder="0"
+                className="w-20 px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+              />
+              小时内已收到过的相同内容 (文本和媒体)
+              <span className="text-xs text-gray-400">(留空不去重)</span>
+            </div>
+          </div>
+          {deliveryMode === 'digest' && (
+            <div className="mt-4">
+              <label className="block text-sm font-medium text-gray-700 mb-1">摘要设置</label>
+              <div className="grid grid-cols-1 md:grid-cols-4 gap-4">
+                <div>
+                  <label className="block text-xs text-gray-500 mb-1">间隔 (分钟)</label>
+                  <input
+                    type="number"
+                    min="0"
+                    value={digestInterval}
+                    onChange={(e) => setDigestInterval(e.target.value)}
+                    placeholder="60"
+                    className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                </div>
+                <div>
+                  <label className="block text-xs text-gray-500 mb-1">或每日定时 (逗号分隔)</label>
+                  <input
+                    type="text"
+                    value={digestAt}
+                    onChange={(e) => setDigestAt(e.target.value)}
+                    placeholder="09:00, 18:00"
+                    className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                </div>
+                <div>
+                  <label className="block text-xs text-gray-500 mb-1">标题</label>
+                  <input
+                    type="text"
+                    value={digestTitle}
+                    onChange={(e) => setDigestTitle(e.target.value)}
+                    placeholder="默认为来源名称"
+                    className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                </div>
+                <div>
+                  <label className="block text-xs text-gray-500 mb-1">最多条目</label>
+                  <input
+                    type="number"
+                    min="0"
+                    value={digestMaxItems}
+                    onChange={(e) => setDigestMaxItems(e.target.value)}
+                    placeholder="不限"
+                    className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                </div>
+              </div>
+              <p className="mt-1 text-xs text-gray-400">时间按规则时区计算; 期间无匹配消息时不发送</p>
+            </div>
+          )}
+          {deliveryMode === 'copy' && (
+            <div className="mt-4 space-y-3">
+              <div>
+                <label className="block text-sm font-medium text-gray-700 mb-1">文本替换 (正则)</label>
+                {replacements.map((r, i) => (
+                  <div key={i} className="flex gap-2 mb-2">
+                    <input
+                      type="text"
+                      value={r.pattern}
+                      onChange={(e) => setReplacements(replacements.map((x, j) => j === i ? { ...x, pattern: e.target.value } : x))}
+                      placeholder="查找, 如 \n-- .*$"
+                      className="flex-1 px-3 py-2 border rounded-md font-mono text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+                    />
+                    <input
+                      type="text"
+                      value={r.replacement}
+                      onChange={(e) => setReplacements(replacements.map((x, j) => j === i ? { ...x, replacement: e.target.value } : x))}
+                      placeholder="替换为, 可用 $1 / ${name}"
+                      className="flex-1 px-3 py-2 border rounded-md font-mono text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+                    />
+                    <button
+                      onClick={() => setReplacements(replacements.filter((_, j) => j !== i))}
+                      className="text-xs text-red-600 hover:underline"
+                    >
+                      删除
+                    </button>
+                  </div>
+                ))}
+                <button
+                  onClick={() => setReplacements([...replacements, { pattern: '', replacement: '' }])}
+                  className="text-xs text-blue-600 hover:underline"
+                >
+                  添加替换
+                </button>
+              </div>
+              <div className="grid grid-cols-1 md:grid-cols-2 gap-4">
+                <div>
+                  <label className="block text-sm font-medium text-gray-700 mb-1">前缀模板</label>
+                  <textarea
+                    value={prefixTemplate}
+                    onChange={(e) => setPrefixTemplate(e.target.value)}
+                    rows={2}
+                    placeholder={'【{{.Source}}】{{index .Groups "name"}}\n'}
+                    className="w-full px-3 py-2 border rounded-md font-mono text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                </div>
+                <div>
+                  <label className="block text-sm font-medium text-gray-700 mb-1">后缀模板</label>
+                  <textarea
+                    value={suffixTemplate}
+                    onChange={(e) => setSuffixTemplate(e.target.value)}
+                    rows={2}
+                    placeholder={'\n{{.Date}} {{.Link}}'}
+                    className="w-full px-3 py-2 border rounded-md font-mono text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+                  />
+                </div>
+              </div>
+              <p className="text-xs text-gray-400">
+                模板变量: {'{{.Source}}'} 来源名称, {'{{.Link}}'} 原消息链接, {'{{.Date}}'} 发布时间（规则时区，未设置时为 UTC）, {'{{index .Groups "name"}}'} 匹配规则中的命名分组
+              </p>
+            </div>
+          )}
+          <div className="mt-4">
+            <label className="block text-sm font-medium text-gray-700 mb-1">测试 (不会转发)</label>
+            <div className="flex gap-2">
+              <textarea
+                rows={2}
+                value={testText}
+                onChange={(e) => setTestText(e.target.value)}
+                placeholder="示例文本; 留空则用来源最近 20 条消息测试"
+                className="flex-1 px-3 py-2 border rounded-md text-sm focus:outline-none focus:ring-2 focus:ring-blue-500"
+              />
+              <button
+                onClick={handleTest}
+                disabled={testing}
+                className="px-4 py-2 bg-gray-600 text-white rounded-md hover:bg-gray-700 text-sm disabled:opacity-50"
+              >
+                {testing ? '测试中...' : '测试'}
+              </button>
+            </div>
+            {testResult && (
+              <div className="mt-2 text-sm">
+                <p className="text-gray-500">扫描 {testResult.scanned} 条, 匹配 {testResult.matched} 条</p>
+                <div className="mt-1 max-h-64 overflow-y-auto divide-y border rounded-md">
+                  {(testResult.messages ?? []).map((m, i) => (
+                    <div key={m.message_id || i} className="px-3 py-2">
+                      <div className="flex items-center gap-2 text-xs text-gray-500">
+                        <span className={`px-2 py-0.5 rounded ${m.matched ? 'bg-green-100 text-green-700' : 'bg-gray-100 text-gray-500'}`}>
+                          {m.matched ? '匹配' : '不匹配'}
+                        </span>
+                        {m.message_id ? <span>#{m.message_id}</span> : null}
+                        {m.sender_name && <span>{m.sender_name}</span>}
+                        {m.date && <span>{new Date(m.date).toLocaleString()}</span>}
+                        {m.rules.length > 0 && <span>已有规则: {m.rules.map((id) => `#${id}`).join(', ')}</span>}
+                      </div>
+                      <p className="mt-1 whitespace-pre-wrap break-words line-clamp-3">{m.text || '(无文本)'}</p>
+                      {m.groups && Object.keys(m.groups).length > 0 && (
+                        <p className="mt-1 text-xs font-mono text-gray-500">
+                          {Object.entries(m.groups).map(([k, v]) => `${k}=${v}`).join('  ')}
+                        </p>
+                      )}
+                    </div>
+                  ))}
+                </div>
+              </div>
+            )}
+          </div>
+          <div className="mt-4">
+            <div className="flex items-center gap-2 text-sm text-gray-700">
+              按来源最近
+              <input
+                type="number"
+                min="1"
+                max="30"
+                value={simDays}
+                onChange={(e) => setSimDays(e.target.value)}
+                className="w-16 px-2 py-1 border rounded-md focus:outline-none focus:ring-2 focus:ring-blue-500"
+              />
+              天的消息模拟投递 (含时段、去重和限速)
+              <button
+                onClick={handleSimulate}
+                disabled={simulating}
+                className="px-3 py-1 bg-gray-600 text-white rounded-md hover:bg-gray-700 text-sm disabled:opacity-50"
+              >
+                {simulating ? '模拟中...' : '模拟'}
+              </button>
+            </div>
+            {simResult && (
+              <div className="mt-2 text-sm">
+                {simResult.truncated && (
+                  <p className="text-xs text-yellow-600">消息过多，仅模拟了最近 {simResult.scanned} 条</p>
+                )}
+                <table className="w-full mt-1 text-xs">
+                  <thead>
+                    <tr className="border-b text-left text-gray-500">
+                      <th className="py-1">日期</th>
+                      <th className="py-1">消息</th>
+                      <th className="py-1">匹配</th>
+                      <th className="py-1">投递</th>
+                      <th className="py-1">限速延迟</th>
+                      <th className="py-1">等待发送</th>
+                      <th className="py-1">去重跳过</th>
+                      <th className="py-1">时段外丢弃</th>
+                    </tr>
+                  </thead>
+                  <tbody>
+                    {[...(simResult.days ?? []), { ...simResult.total, date: '合计' }].map((d) => (
+                      <tr key={d.date} className={`border-b ${d.date === '合计' ? 'font-medium' : ''}`}>
+                        <td className="py-1">{d.date}</td>
+                        <td className="py-1">{d.scanned}</td>
+                        <td className="py-1">{d.matched}</td>
+                        <td className="py-1">{d.delivered}</td>
+                        <td className="py-1">{d.rate_limited}</td>
+                        <td className="py-1">{d.held}</td>
+                        <td className="py-1">{d.duplicates}</td>
+                        <td className="py-1">{d.outside_schedule}</td>
+                      </tr>
+                    ))}
+                  </tbody>
+                </table>
+                {([
+                  ['最近匹配', simResult.matches],
+                  ['最近限速延迟', simResult.rate_limited],
+                ] as [string, SimulationSample[] | null][]).map(([label, samples]) => samples?.length ? (
+                  <div key={label} className="mt-2">
+                    <p className="text-xs text-gray-500">{label}</p>
+                    <div className="max-h-48 overflow-y-auto divide-y border rounded-md">
+                      {samples.map((m, i) => (
+                        <div key={i} className="px-3 py-1 flex gap-2 text-xs">
+                          <span className="text-gray-500 whitespace-nowrap">{new Date(m.date).toLocaleString()}</span>
+                          <span className="whitespace-nowrap">{outcomeLabel[m.outcome] ?? m.outcome}</span>
+                          {m.delay > 0 && <span className="text-gray-500 whitespace-nowrap">+{formatDelay(m.delay)}</span>}
+                          {m.target && <span className="text-gray-500 whitespace-nowrap">→ {m.target}</span>}
+                          <span className="truncate">{m.text}</span>
+                        </div>
+                      ))}
+                    </div>
+                  </div>
+                ) : null)}
+              </div>
+            )}
           </div>
           <div className="flex gap-2 mt-4">
             <button
@@ -220,6 +1326,7 @@ export default function RulesPage() {
               <th className="px-4 py-3">来源</th>
               <th className="px-4 py-3">目标</th>
               <th className="px-4 py-3">匹配规则</th>
+              <th className="px-4 py-3">方式</th>
               <th className="px-4 py-3">状态</th>
               <th className="px-4 py-3">操作</th>
             </tr>
@@ -228,8 +1335,13 @@ export default function RulesPage() {
             {rules.map((rule) => (
               <tr key={rule.id}>
                 <td className="px-4 py-3 text-sm">{rule.source_name || rule.source_channel_id}</td>
-                <td className="px-4 py-3 text-sm">{rule.target_name || rule.target_channel_id}</td>
+                <td className="px-4 py-3 text-sm">
+                  {(rule.targets ?? []).map((t) => (
+                    <div key={t.id}>{t.target_name || t.target_channel_id}</div>
+                  ))}
+                </td>
                 <td className="px-4 py-3 text-sm font-mono text-xs">{rule.match_pattern}</td>
+                <td className="px-4 py-3 text-sm">{modeLabel[rule.delivery_mode] ?? rule.delivery_mode}</td>
                 <td className="px-4 py-3">
                   <button
                     onClick={() => handleToggle(rule)}
@@ -241,6 +1353,9 @@ export default function RulesPage() {
                   >
                     {rule.enabled ? '已启用' : '已禁用'}
                   </button>
+                  {rule.enabled && !rule.active_now && (
+                    <div className="mt-1 text-xs text-gray-400">当前不在生效时段</div>
+                  )}
                 </td>
                 <td className="px-4 py-3">
                   <div className="flex gap-2">
@@ -250,6 +1365,12 @@ export default function RulesPage() {
                     >
                       编辑
                     </button>
+                    <Link
+                      to={`/backfill?rule_id=${rule.id}`}
+                      className="text-xs text-blue-600 hover:underline"
+                    >
+                      回填
+                    </Link>
                     <button
                       onClick={() => handleDelete(rule.id)}
                       className="text-xs text-red-600 hover:underline"
@@ -262,7 +1383,7 @@ export default function RulesPage() {
             ))}
             {rules.length === 0 && (
               <tr>
-                <td colSpan={5} className="px-4 py-8 text-center text-gray-400">
+                <td colSpan={6} className="px-4 py-8 text-center text-gray-400">
                   暂无转发规则
                 </td>
               </tr>
@@ -74,11 +74,21 @@ func (a *ApiServer) registerRpcMethods() {
 	// Dialog methods
 	a.rpcHandler.RegisterMethod(&DialogsListMethod{tgSvc: a.tgSvc})
 	a.rpcHandler.RegisterMethod(&ChannelsListMethod{tgSvc: a.tgSvc})
+	a.rpcHandler.RegisterMethod(&TopicsListMethod{tgSvc: a.tgSvc})
 	// Rule methods
 	a.rpcHandler.RegisterMethod(&RulesCreateMethod{storage: a.storage, engine: a.engine})
 	a.rpcHandler.RegisterMethod(&RulesListMethod{storage: a.storage})
 	a.rpcHandler.RegisterMethod(&RulesUpdateMethod{storage: a.storage, engine: a.engine})
 	a.rpcHandler.RegisterMethod(&RulesDeleteMethod{storage: a.storage, engine: a.engine})
+	a.rpcHandler.RegisterMethod(&RulesBackfillMethod{storage: a.storage, engine: a.engine})
+	a.rpcHandler.RegisterMethod(&RulesTestMethod{engine: a.engine})
+	a.rpcHandler.RegisterMethod(&RulesSimulateMethod{storage: a.storage, engine: a.engine})
 	// Message methods
 	a.rpcHandler.RegisterMethod(&MessagesHistoryMethod{tgSvc: a.tgSvc})
+	// Log methods
+	a.rpcHandler.RegisterMethod(&LogsListMethod{storage: a.storage})
+	// Backfill methods
+	a.rpcHandler.RegisterMethod(&BackfillListMethod{storage: a.storage})
+	a.rpcHandler.RegisterMethod(&BackfillGetMethod{storage: a.storage})
+	a.rpcHandler.RegisterMethod(&BackfillCancelMethod{storage: a.storage, engine: a.engine})
 }
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tg-manager/internal/forwarder"
+	"github.com/tg-manager/internal/storage"
+)
+
+// backfill.list
+type BackfillListMethod struct {
+	storage *storage.Storage
+}
+
+type backfillListParams struct {
+	RuleID uint `json:"rule_id"`
+	Limit  int  `json:"limit"`
+}
+
+func (m *BackfillListMethod) Name() string { return "backfill.list" }
+func (m *BackfillListMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p backfillListParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+	}
+	if p.Limit <= 0 || p.Limit > 500 {
+		p.Limit = 100
+	}
+
+	query := m.storage.GetDB().Order("id desc").Limit(p.Limit)
+	if p.RuleID != 0 {
+		query = query.Where("rule_id = ?", p.RuleID)
+	}
+
+	jobs := []storage.BackfillJob{}
+	if err := query.Find(&jobs).Error; err != nil {
+		return nil, fmt.Errorf("list backfill jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// backfill.get
+type BackfillGetMethod struct {
+	storage *storage.Storage
+}
+
+type backfillJobParams struct {
+	ID uint `json:"id"`
+}
+
+func (m *BackfillGetMethod) Name() string { return "backfill.get" }
+func (m *BackfillGetMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p backfillJobParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	if p.ID == 0 {
+		return nil, fmt.Errorf("id is required")
+	}
+
+	var job storage.BackfillJob
+	if err := m.storage.GetDB().First(&job, p.ID).Error; err != nil {
+		return nil, fmt.Errorf("backfill job not found: %w", err)
+	}
+	return job, nil
+}
+
+// backfill.cancel
+type BackfillCancelMethod struct {
+	storage *storage.Storage
+	engine  *forwarder.Engine
+}
+
+func (m *BackfillCancelMethod) Name() string { return "backfill.cancel" }
+func (m *BackfillCancelMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p backfillJobParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	if p.ID == 0 {
+		return nil, fmt.Errorf("id is required")
+	}
+
+	if err := m.engine.CancelBackfill(p.ID); err != nil {
+		return nil, err
+	}
+
+	var job storage.BackfillJob
+	if err := m.storage.GetDB().First(&job, p.ID).Error; err != nil {
+		return nil, fmt.Errorf("backfill job not found: %w", err)
+	}
+	return job, nil
+}
@@ -18,6 +18,7 @@ type DialogInfo struct {
 	UnreadCount int    `json:"unread_count"`
 	LastMessage string `json:"last_message"`
 	AccessHash  int64  `json:"access_hash,string"`
+	Forum       bool   `json:"forum"` // supergroup with topics, see topics.list
 }
 
 // dialogs.list
@@ -152,6 +153,10 @@ func resolveDialogInfo(dlg *tg.Dialog, users map[int64]*tg.User, chats map[int64
 		info.ID = p.ChannelID
 		info.Type = "channel"
 		if ch, ok := channels[p.ChannelID]; ok {
+			if ch.Megagroup {
+				info.Type = "supergroup"
+			}
+			info.Forum = ch.Forum
 			info.Name = ch.Title
 			info.AccessHash, _ = ch.GetAccessHash()
 		} else {
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tg-manager/internal/storage"
+)
+
+// logs.list
+type LogsListMethod struct {
+	storage *storage.Storage
+}
+
+type logsListParams struct {
+	RuleID uint `json:"rule_id"`
+	Limit  int  `json:"limit"`
+}
+
+func (m *LogsListMethod) Name() string { return "logs.list" }
+func (m *LogsListMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p logsListParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+	}
+	if p.Limit <= 0 || p.Limit > 500 {
+		p.Limit = 100
+	}
+
+	query := m.storage.GetDB().Order("id desc").Limit(p.Limit)
+	if p.RuleID != 0 {
+		query = query.Where("rule_id = ?", p.RuleID)
+	}
+
+	logs := []storage.ForwardLog{}
+	if err := query.Find(&logs).Error; err != nil {
+		return nil, fmt.Errorf("list logs: %w", err)
+	}
+	return logs, nil
+}
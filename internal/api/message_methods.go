@@ -51,7 +51,7 @@ func (m *MessagesHistoryMethod) Execute(ctx context.Context, params json.RawMess
 		peer = &tg.InputPeerUser{UserID: p.PeerID, AccessHash: p.AccessHash}
 	case "group":
 		peer = &tg.InputPeerChat{ChatID: p.PeerID}
-	case "channel":
+	case "channel", "supergroup":
 		peer = &tg.InputPeerChannel{ChannelID: p.PeerID, AccessHash: p.AccessHash}
 	default:
 		return nil, fmt.Errorf("unsupported peer_type: %s", p.PeerType)
@@ -1,13 +1,18 @@
 package api
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
-	"regexp"
+	"slices"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/tg-manager/internal/forwarder"
 	"github.com/tg-manager/internal/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // rules.create
@@ -17,48 +22,218 @@ type RulesCreateMethod struct {
 }
 
 type createRuleParams struct {
-	SourceChannelID int64  `json:"source_channel_id"`
-	SourceName      string `json:"source_name"`
-	SourceHash      int64  `json:"source_hash,string"`
-	TargetChannelID int64  `json:"target_channel_id"`
-	TargetName      string `json:"target_name"`
-	TargetHash      int64  `json:"target_hash,string"`
-	MatchPattern    string `json:"match_pattern"`
+	SourceChannelID int64                     `json:"source_channel_id"`
+	SourceType      string                    `json:"source_type"`
+	SourceName      string                    `json:"source_name"`
+	SourceHash      int64                     `json:"source_hash,string"`
+	SourceTopicIDs  []int                     `json:"source_topic_ids"`
+	Targets         []targetParams            `json:"targets"`
+	MatchPattern    string                    `json:"match_pattern"`
+	Conditions      storage.RuleConditions    `json:"conditions"`
+	Senders         storage.SenderFilter      `json:"senders"`
+	DeliveryMode    string                    `json:"delivery_mode"`
+	Replacements    []storage.TextReplacement `json:"replacements"`
+	PrefixTemplate  string                    `json:"prefix_template"`
+	SuffixTemplate  string                    `json:"suffix_template"`
+	MediaTypes      []string                  `json:"media_types"`
+	MimeTypes       []string                  `json:"mime_types"`
+	FileNamePattern string                    `json:"file_name_pattern"`
+	MinSize         int64                     `json:"min_size"`
+	MaxSize         int64                     `json:"max_size"`
+	RateLimit       *int                      `json:"rate_limit"`
+	RatePeriod      *int                      `json:"rate_period"`
+	RateBurst       *int                      `json:"rate_burst"`
+	ForwardEdits    bool                      `json:"forward_edits"`
+	SyncDeletes     bool                      `json:"sync_deletes"`
+	Schedule        storage.RuleSchedule      `json:"schedule"`
+	Digest          storage.DigestConfig      `json:"digest"`
 }
 
-func (m *RulesCreateMethod) Name() string { return "rules.create" }
-func (m *RulesCreateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
-	var p createRuleParams
-	if err := json.Unmarshal(params, &p); err != nil {
-		return nil, fmt.Errorf("invalid params: %w", err)
-	}
-	if p.SourceChannelID == 0 || p.TargetChannelID == 0 || p.MatchPattern == "" {
-		return nil, fmt.Errorf("source_channel_id, target_channel_id, and match_pattern are required")
+// rule builds the rule described by the params, with defaults applied.
+func (p createRuleParams) rule() storage.ForwardRule {
+	if p.DeliveryMode == "" {
+		p.DeliveryMode = storage.DeliveryModeForward
 	}
-	if _, err := regexp.Compile(p.MatchPattern); err != nil {
-		return nil, fmt.Errorf("invalid regex pattern: %w", err)
+	if p.SourceType == "" {
+		p.SourceType = storage.PeerTypeChannel
 	}
 
-	rule := storage.ForwardRule{
+	return storage.ForwardRule{
 		SourceChannelID: p.SourceChannelID,
+		SourceType:      p.SourceType,
 		SourceName:      p.SourceName,
 		SourceHash:      p.SourceHash,
-		TargetChannelID: p.TargetChannelID,
-		TargetName:      p.TargetName,
-		TargetHash:      p.TargetHash,
+		SourceTopicIDs:  p.SourceTopicIDs,
+		Targets:         toTargets(p.Targets),
 		MatchPattern:    p.MatchPattern,
+		Conditions:      p.Conditions,
+		Senders:         p.Senders,
+		DeliveryMode:    p.DeliveryMode,
+		Replacements:    p.Replacements,
+		PrefixTemplate:  p.PrefixTemplate,
+		SuffixTemplate:  p.SuffixTemplate,
+		MediaTypes:      p.MediaTypes,
+		MimeTypes:       p.MimeTypes,
+		FileNamePattern: p.FileNamePattern,
+		MinSize:         p.MinSize,
+		MaxSize:         p.MaxSize,
+		RateLimit:       intOr(p.RateLimit, 1),
+		RatePeriod:      intOr(p.RatePeriod, 60),
+		RateBurst:       intOr(p.RateBurst, 1),
+		ForwardEdits:    p.ForwardEdits,
+		SyncDeletes:     p.SyncDeletes,
+		Schedule:        p.Schedule,
+		Digest:          p.Digest,
 		Enabled:         true,
 	}
+}
+
+func (m *RulesCreateMethod) Name() string { return "rules.create" }
+func (m *RulesCreateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p createRuleParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	if p.SourceChannelID == 0 || len(p.Targets) == 0 {
+		return nil, fmt.Errorf("source_channel_id and targets are required")
+	}
+	rule := p.rule()
+	if err := forwarder.ValidateRule(rule); err != nil {
+		return nil, fmt.Errorf("invalid rule: %w", err)
+	}
 
 	if err := m.storage.GetDB().Create(&rule).Error; err != nil {
 		return nil, fmt.Errorf("create rule: %w", err)
 	}
 
 	_ = m.engine.ReloadRules()
-	go m.engine.BackfillRule(rule)
+	if _, err := m.engine.StartBackfill(rule.ID, forwarder.BackfillOptions{}); err != nil {
+		log.Error().Err(err).Uint("rule_id", rule.ID).Msg("Failed to start backfill")
+	}
+	rule.ActiveNow = forwarder.ActiveNow(rule, time.Now())
 	return rule, nil
 }
 
+type targetParams struct {
+	TargetChannelID int64  `json:"target_channel_id"`
+	TargetType      string `json:"target_type"`
+	TargetName      string `json:"target_name"`
+	TargetHash      int64  `json:"target_hash,string"`
+	TopicID         int    `json:"topic_id"`
+	WebhookURL      string `json:"webhook_url"`
+	WebhookSecret   string `json:"webhook_secret"`
+	DedupHours      int    `json:"dedup_hours"`
+	RateLimit       int    `json:"rate_limit"`
+	RatePeriod      int    `json:"rate_period"`
+	RateBurst       int    `json:"rate_burst"`
+}
+
+func intOr(v *int, def int) int {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+func toTargets(params []targetParams) []storage.ForwardTarget {
+	targets := make([]storage.ForwardTarget, 0, len(params))
+	for _, t := range params {
+		targets = append(targets, storage.ForwardTarget{
+			TargetChannelID: t.TargetChannelID,
+			TargetType:      cmp.Or(t.TargetType, storage.PeerTypeChannel),
+			TargetName:      t.TargetName,
+			TargetHash:      t.TargetHash,
+			TopicID:         t.TopicID,
+			WebhookURL:      t.WebhookURL,
+			WebhookSecret:   t.WebhookSecret,
+			DedupHours:      t.DedupHours,
+			RateLimit:       t.RateLimit,
+			RatePeriod:      t.RatePeriod,
+			RateBurst:       t.RateBurst,
+		})
+	}
+	return targets
+}
+
+// syncTargets makes the rule's targets match the given list. Existing target
+// rows are kept (and their forward log history with them) when the same
+// destination is still present; an empty webhook secret keeps the stored
+// one, as the API does not return it.
+func syncTargets(tx *gorm.DB, ruleID uint, targets []storage.ForwardTarget) error {
+	var existing []storage.ForwardTarget
+	if err := tx.Where("rule_id = ?", ruleID).Find(&existing).Error; err != nil {
+		return err
+	}
+
+	type peer struct {
+		typ string
+		id  int64
+		url string // webhooks
+	}
+	key := func(t storage.ForwardTarget) peer {
+		// Supergroups are channels in the API
+		if t.TargetType == storage.PeerTypeSupergroup {
+			return peer{storage.PeerTypeChannel, t.TargetChannelID, ""}
+		}
+		return peer{t.TargetType, t.TargetChannelID, t.WebhookURL}
+	}
+
+	keep := make(map[peer]bool)
+	for _, t := range targets {
+		keep[key(t)] = true
+		idx := slices.IndexFunc(existing, func(e storage.ForwardTarget) bool {
+			return key(e) == key(t)
+		})
+		if idx >= 0 {
+			columns := map[string]interface{}{
+				"target_type": t.TargetType,
+				"target_name": t.TargetName,
+				"target_hash": t.TargetHash,
+				"topic_id":    t.TopicID,
+				"dedup_hours": t.DedupHours,
+				"rate_limit":  t.RateLimit,
+				"rate_period": t.RatePeriod,
+				"rate_burst":  t.RateBurst,
+			}
+			if t.WebhookSecret != "" {
+				columns["webhook_secret"] = t.WebhookSecret
+			}
+			err := tx.Model(&existing[idx]).Updates(columns).Error
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		t.RuleID = ruleID
+		if err := tx.Create(&t).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, e := range existing {
+		if !keep[key(e)] {
+			if err := deleteDeliveryState(tx, "target_id = ?", e.ID); err != nil {
+				return err
+			}
+			if err := tx.Delete(&e).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteDeliveryState removes queued deliveries and message mappings of a
+// deleted rule or target.
+func deleteDeliveryState(tx *gorm.DB, query string, id uint) error {
+	for _, model := range []interface{}{&storage.OutboxItem{}, &storage.MessageMapping{}} {
+		if err := tx.Where(query, id).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // rules.list
 type RulesListMethod struct {
 	storage *storage.Storage
@@ -67,9 +242,13 @@ type RulesListMethod struct {
 func (m *RulesListMethod) Name() string { return "rules.list" }
 func (m *RulesListMethod) Execute(ctx context.Context, _ json.RawMessage) (interface{}, error) {
 	var rules []storage.ForwardRule
-	if err := m.storage.GetDB().Order("id desc").Find(&rules).Error; err != nil {
+	if err := m.storage.GetDB().Preload("Targets").Order("id desc").Find(&rules).Error; err != nil {
 		return nil, fmt.Errorf("list rules: %w", err)
 	}
+	now := time.Now()
+	for i := range rules {
+		rules[i].ActiveNow = forwarder.ActiveNow(rules[i], now)
+	}
 	return rules, nil
 }
 
@@ -80,15 +259,70 @@ type RulesUpdateMethod struct {
 }
 
 type updateRuleParams struct {
-	ID              uint   `json:"id"`
-	SourceChannelID *int64 `json:"source_channel_id,omitempty"`
-	SourceName      *string `json:"source_name,omitempty"`
-	SourceHash      *int64  `json:"source_hash,omitempty,string"`
-	TargetChannelID *int64 `json:"target_channel_id,omitempty"`
-	TargetName      *string `json:"target_name,omitempty"`
-	TargetHash      *int64  `json:"target_hash,omitempty,string"`
-	MatchPattern    *string `json:"match_pattern,omitempty"`
-	Enabled         *bool  `json:"enabled,omitempty"`
+	ID              uint                       `json:"id"`
+	SourceChannelID *int64                     `json:"source_channel_id,omitempty"`
+	SourceType      *string                    `json:"source_type,omitempty"`
+	SourceName      *string                    `json:"source_name,omitempty"`
+	SourceHash      *int64                     `json:"source_hash,omitempty,string"`
+	SourceTopicIDs  *[]int                     `json:"source_topic_ids,omitempty"`
+	Targets         *[]targetParams            `json:"targets,omitempty"`
+	MatchPattern    *string                    `json:"match_pattern,omitempty"`
+	Conditions      *storage.RuleConditions    `json:"conditions,omitempty"`
+	Senders         *storage.SenderFilter      `json:"senders,omitempty"`
+	DeliveryMode    *string                    `json:"delivery_mode,omitempty"`
+	Replacements    *[]storage.TextReplacement `json:"replacements,omitempty"`
+	PrefixTemplate  *string                    `json:"prefix_template,omitempty"`
+	SuffixTemplate  *string                    `json:"suffix_template,omitempty"`
+	MediaTypes      *[]string                  `json:"media_types,omitempty"`
+	MimeTypes       *[]string                  `json:"mime_types,omitempty"`
+	FileNamePattern *string                    `json:"file_name_pattern,omitempty"`
+	MinSize         *int64                     `json:"min_size,omitempty"`
+	MaxSize         *int64                     `json:"max_size,omitempty"`
+	RateLimit       *int                       `json:"rate_limit,omitempty"`
+	RatePeriod      *int                       `json:"rate_period,omitempty"`
+	RateBurst       *int                       `json:"rate_burst,omitempty"`
+	ForwardEdits    *bool                      `json:"forward_edits,omitempty"`
+	SyncDeletes     *bool                      `json:"sync_deletes,omitempty"`
+	Schedule        *storage.RuleSchedule      `json:"schedule,omitempty"`
+	Digest          *storage.DigestConfig      `json:"digest,omitempty"`
+	Enabled         *bool                      `json:"enabled,omitempty"`
+}
+
+// apply copies the set fields onto rule and returns the changed columns.
+func (p updateRuleParams) apply(rule *storage.ForwardRule) []string {
+	var columns []string
+	set := func(column string, ok bool, assign func()) {
+		if ok {
+			assign()
+			columns = append(columns, column)
+		}
+	}
+	set("source_channel_id", p.SourceChannelID != nil, func() { rule.SourceChannelID = *p.SourceChannelID })
+	set("source_type", p.SourceType != nil, func() { rule.SourceType = *p.SourceType })
+	set("source_name", p.SourceName != nil, func() { rule.SourceName = *p.SourceName })
+	set("source_hash", p.SourceHash != nil, func() { rule.SourceHash = *p.SourceHash })
+	set("source_topic_ids", p.SourceTopicIDs != nil, func() { rule.SourceTopicIDs = *p.SourceTopicIDs })
+	set("match_pattern", p.MatchPattern != nil, func() { rule.MatchPattern = *p.MatchPattern })
+	set("conditions", p.Conditions != nil, func() { rule.Conditions = *p.Conditions })
+	set("senders", p.Senders != nil, func() { rule.Senders = *p.Senders })
+	set("delivery_mode", p.DeliveryMode != nil, func() { rule.DeliveryMode = *p.DeliveryMode })
+	set("replacements", p.Replacements != nil, func() { rule.Replacements = *p.Replacements })
+	set("prefix_template", p.PrefixTemplate != nil, func() { rule.PrefixTemplate = *p.PrefixTemplate })
+	set("suffix_template", p.SuffixTemplate != nil, func() { rule.SuffixTemplate = *p.SuffixTemplate })
+	set("media_types", p.MediaTypes != nil, func() { rule.MediaTypes = *p.MediaTypes })
+	set("mime_types", p.MimeTypes != nil, func() { rule.MimeTypes = *p.MimeTypes })
+	set("file_name_pattern", p.FileNamePattern != nil, func() { rule.FileNamePattern = *p.FileNamePattern })
+	set("min_size", p.MinSize != nil, func() { rule.MinSize = *p.MinSize })
+	set("max_size", p.MaxSize != nil, func() { rule.MaxSize = *p.MaxSize })
+	set("rate_limit", p.RateLimit != nil, func() { rule.RateLimit = *p.RateLimit })
+	set("rate_period", p.RatePeriod != nil, func() { rule.RatePeriod = *p.RatePeriod })
+	set("rate_burst", p.RateBurst != nil, func() { rule.RateBurst = *p.RateBurst })
+	set("forward_edits", p.ForwardEdits != nil, func() { rule.ForwardEdits = *p.ForwardEdits })
+	set("sync_deletes", p.SyncDeletes != nil, func() { rule.SyncDeletes = *p.SyncDeletes })
+	set("schedule", p.Schedule != nil, func() { rule.Schedule = *p.Schedule })
+	set("digest", p.Digest != nil, func() { rule.Digest = *p.Digest })
+	set("enabled", p.Enabled != nil, func() { rule.Enabled = *p.Enabled })
+	return columns
 }
 
 func (m *RulesUpdateMethod) Name() string { return "rules.update" }
@@ -102,46 +336,39 @@ func (m *RulesUpdateMethod) Execute(ctx context.Context, params json.RawMessage)
 	}
 
 	var rule storage.ForwardRule
-	if err := m.storage.GetDB().First(&rule, p.ID).Error; err != nil {
+	if err := m.storage.GetDB().Preload("Targets").First(&rule, p.ID).Error; err != nil {
 		return nil, fmt.Errorf("rule not found: %w", err)
 	}
 
-	updates := make(map[string]interface{})
-	if p.SourceChannelID != nil {
-		updates["source_channel_id"] = *p.SourceChannelID
-	}
-	if p.SourceName != nil {
-		updates["source_name"] = *p.SourceName
-	}
-	if p.SourceHash != nil {
-		updates["source_hash"] = *p.SourceHash
+	columns := p.apply(&rule)
+	if p.Targets != nil {
+		rule.Targets = toTargets(*p.Targets)
 	}
-	if p.TargetChannelID != nil {
-		updates["target_channel_id"] = *p.TargetChannelID
+	if len(columns) == 0 && p.Targets == nil {
+		return rule, nil
 	}
-	if p.TargetName != nil {
-		updates["target_name"] = *p.TargetName
-	}
-	if p.TargetHash != nil {
-		updates["target_hash"] = *p.TargetHash
-	}
-	if p.MatchPattern != nil {
-		if _, err := regexp.Compile(*p.MatchPattern); err != nil {
-			return nil, fmt.Errorf("invalid regex pattern: %w", err)
-		}
-		updates["match_pattern"] = *p.MatchPattern
-	}
-	if p.Enabled != nil {
-		updates["enabled"] = *p.Enabled
+	if err := forwarder.ValidateRule(rule); err != nil {
+		return nil, fmt.Errorf("invalid rule: %w", err)
 	}
 
-	if err := m.storage.GetDB().Model(&rule).Updates(updates).Error; err != nil {
+	columns = append(columns, "updated_at")
+	err := m.storage.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&rule).Select(columns).Omit(clause.Associations).Updates(&rule).Error; err != nil {
+			return err
+		}
+		if p.Targets != nil {
+			return syncTargets(tx, rule.ID, rule.Targets)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, fmt.Errorf("update rule: %w", err)
 	}
 
 	// Reload updated rule
-	m.storage.GetDB().First(&rule, p.ID)
+	m.storage.GetDB().Preload("Targets").First(&rule, p.ID)
 	_ = m.engine.ReloadRules()
+	rule.ActiveNow = forwarder.ActiveNow(rule, time.Now())
 	return rule, nil
 }
 
@@ -165,10 +392,179 @@ func (m *RulesDeleteMethod) Execute(ctx context.Context, params json.RawMessage)
 		return nil, fmt.Errorf("id is required")
 	}
 
-	if err := m.storage.GetDB().Delete(&storage.ForwardRule{}, p.ID).Error; err != nil {
+	err := m.storage.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := deleteDeliveryState(tx, "rule_id = ?", p.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("rule_id = ?", p.ID).Delete(&storage.DigestEntry{}).Error; err != nil {
+			return err
+		}
+		// Stops running jobs of the rule
+		if err := tx.Where("rule_id = ?", p.ID).Delete(&storage.BackfillJob{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&storage.ForwardRule{}, p.ID).Error
+	})
+	if err != nil {
 		return nil, fmt.Errorf("delete rule: %w", err)
 	}
 
 	_ = m.engine.ReloadRules()
 	return map[string]bool{"deleted": true}, nil
 }
+
+// rules.backfill
+type RulesBackfillMethod struct {
+	storage *storage.Storage
+	engine  *forwarder.Engine
+}
+
+type backfillRuleParams struct {
+	ID            uint       `json:"id"`
+	Limit         int        `json:"limit"`           // messages to scan, newest first
+	Since         *time.Time `json:"since"`           // RFC 3339
+	Until         *time.Time `json:"until"`           // RFC 3339
+	FromMessageID int        `json:"from_message_id"` // scan down to this message
+}
+
+func (m *RulesBackfillMethod) Name() string { return "rules.backfill" }
+func (m *RulesBackfillMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p backfillRuleParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	if p.ID == 0 {
+		return nil, fmt.Errorf("id is required")
+	}
+
+	opts := forwarder.BackfillOptions{Limit: p.Limit, FromMessageID: p.FromMessageID}
+	if p.Since != nil {
+		opts.Since = *p.Since
+	}
+	if p.Until != nil {
+		opts.Until = *p.Until
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+
+	var rule storage.ForwardRule
+	if err := m.storage.GetDB().Preload("Targets").First(&rule, p.ID).Error; err != nil {
+		return nil, fmt.Errorf("rule not found: %w", err)
+	}
+	if !rule.Enabled {
+		return nil, fmt.Errorf("rule %d is disabled", rule.ID)
+	}
+
+	return m.engine.StartBackfill(rule.ID, opts)
+}
+
+// rules.test
+type RulesTestMethod struct {
+	engine *forwarder.Engine
+}
+
+// testRuleParams holds the matching options of a candidate rule and what to
+// test it on: sample text, or else the latest posts of the source.
+type testRuleParams struct {
+	Text            string                 `json:"text"`
+	SourceChannelID int64                  `json:"source_channel_id"`
+	SourceType      string                 `json:"source_type"`
+	SourceHash      int64                  `json:"source_hash,string"`
+	SourceTopicIDs  []int                  `json:"source_topic_ids"`
+	Limit           int                    `json:"limit"` // posts of the source to test
+	MatchPattern    string                 `json:"match_pattern"`
+	Conditions      storage.RuleConditions `json:"conditions"`
+	Senders         storage.SenderFilter   `json:"senders"`
+	MediaTypes      []string               `json:"media_types"`
+	MimeTypes       []string               `json:"mime_types"`
+	FileNamePattern string                 `json:"file_name_pattern"`
+	MinSize         int64                  `json:"min_size"`
+	MaxSize         int64                  `json:"max_size"`
+}
+
+func (m *RulesTestMethod) Name() string { return "rules.test" }
+func (m *RulesTestMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p testRuleParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	if p.Text == "" && p.SourceChannelID == 0 {
+		return nil, fmt.Errorf("text or source_channel_id is required")
+	}
+
+	rule := storage.ForwardRule{
+		SourceChannelID: p.SourceChannelID,
+		SourceType:      cmp.Or(p.SourceType, storage.PeerTypeChannel),
+		SourceHash:      p.SourceHash,
+		SourceTopicIDs:  p.SourceTopicIDs,
+		MatchPattern:    p.MatchPattern,
+		Conditions:      p.Conditions,
+		Senders:         p.Senders,
+		MediaTypes:      p.MediaTypes,
+		MimeTypes:       p.MimeTypes,
+		FileNamePattern: p.FileNamePattern,
+		MinSize:         p.MinSize,
+		MaxSize:         p.MaxSize,
+	}
+
+	var (
+		res forwarder.TestResult
+		err error
+	)
+	if p.Text != "" {
+		res, err = m.engine.TestText(rule, p.Text)
+	} else {
+		res, err = m.engine.TestSource(ctx, rule, p.Limit)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("test rule: %w", err)
+	}
+	return res, nil
+}
+
+// rules.simulate
+type RulesSimulateMethod struct {
+	storage *storage.Storage
+	engine  *forwarder.Engine
+}
+
+// simulateRuleParams select an existing rule by ID, or describe a rule that
+// is not created yet like rules.create.
+type simulateRuleParams struct {
+	ID   uint              `json:"id"`
+	Rule *createRuleParams `json:"rule"`
+	Days int               `json:"days"` // history to replay
+}
+
+func (m *RulesSimulateMethod) Name() string { return "rules.simulate" }
+func (m *RulesSimulateMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p simulateRuleParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+
+	var rule storage.ForwardRule
+	switch {
+	case p.ID != 0:
+		if err := m.storage.GetDB().Preload("Targets").First(&rule, p.ID).Error; err != nil {
+			return nil, fmt.Errorf("rule not found: %w", err)
+		}
+	case p.Rule != nil:
+		if p.Rule.SourceChannelID == 0 || len(p.Rule.Targets) == 0 {
+			return nil, fmt.Errorf("source_channel_id and targets are required")
+		}
+		rule = p.Rule.rule()
+		if err := forwarder.ValidateRule(rule); err != nil {
+			return nil, fmt.Errorf("invalid rule: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("id or rule is required")
+	}
+
+	res, err := m.engine.Simulate(ctx, rule, p.Days)
+	if err != nil {
+		return nil, fmt.Errorf("simulate rule: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/telegram"
+)
+
+type TopicInfo struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	Closed bool   `json:"closed"`
+	Hidden bool   `json:"hidden"`
+}
+
+// topics.list
+type TopicsListMethod struct {
+	tgSvc *telegram.Service
+}
+
+type topicsListParams struct {
+	ChannelID  int64 `json:"channel_id"`
+	AccessHash int64 `json:"access_hash,string"`
+	Limit      int   `json:"limit"`
+}
+
+func (m *TopicsListMethod) Name() string { return "topics.list" }
+func (m *TopicsListMethod) Execute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p topicsListParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	if p.ChannelID == 0 {
+		return nil, fmt.Errorf("channel_id is required")
+	}
+	if p.Limit <= 0 || p.Limit > 100 {
+		p.Limit = 100
+	}
+
+	api := m.tgSvc.API()
+	resp, err := api.MessagesGetForumTopics(ctx, &tg.MessagesGetForumTopicsRequest{
+		Peer:  &tg.InputPeerChannel{ChannelID: p.ChannelID, AccessHash: p.AccessHash},
+		Limit: p.Limit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get forum topics: %w", err)
+	}
+
+	result := []TopicInfo{}
+	for _, t := range resp.Topics {
+		topic, ok := t.(*tg.ForumTopic)
+		if !ok {
+			continue
+		}
+		result = append(result, TopicInfo{
+			ID:     topic.ID,
+			Title:  topic.Title,
+			Closed: topic.Closed,
+			Hidden: topic.Hidden,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package forwarder
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+// albumWait is how long to wait for further parts of an album after the
+// last one arrived before handling the album.
+const albumWait = 1500 * time.Millisecond
+
+type albumKey struct {
+	source    peerRef
+	groupedID int64
+}
+
+type albumBuffer struct {
+	msgs   []*tg.Message
+	sender sender // of the first part
+	timer  *time.Timer
+}
+
+// bufferAlbum collects album parts until no new part arrived for albumWait,
+// then handles the album as a whole.
+func (e *Engine) bufferAlbum(source peerRef, msg *tg.Message, snd sender) {
+	key := albumKey{source: source, groupedID: msg.GroupedID}
+
+	e.albumMu.Lock()
+	defer e.albumMu.Unlock()
+
+	buf, ok := e.albums[key]
+	if !ok {
+		buf = &albumBuffer{sender: snd}
+		buf.timer = time.AfterFunc(albumWait, func() { e.flushAlbum(key) })
+		e.albums[key] = buf
+	} else {
+		buf.timer.Reset(albumWait)
+	}
+	buf.msgs = append(buf.msgs, msg)
+}
+
+func (e *Engine) flushAlbum(key albumKey) {
+	e.albumMu.Lock()
+	buf, ok := e.albums[key]
+	delete(e.albums, key)
+	e.albumMu.Unlock()
+	if !ok {
+		return
+	}
+
+	msgs := buf.msgs
+	slices.SortFunc(msgs, func(a, b *tg.Message) int { return a.ID - b.ID })
+	e.handleMessages(key.source, msgs, buf.sender)
+}
+
+// groupAlbums converts a history page (newest first) into forwarding units in
+// chronological order, keeping the parts of an album together.
+func groupAlbums(history []tg.MessageClass) [][]*tg.Message {
+	var units [][]*tg.Message
+	for i := len(history) - 1; i >= 0; i-- {
+		msg, ok := history[i].(*tg.Message)
+		if !ok {
+			continue
+		}
+		if n := len(units); n > 0 && msg.GroupedID != 0 && units[n-1][0].GroupedID == msg.GroupedID {
+			units[n-1] = append(units[n-1], msg)
+			continue
+		}
+		units = append(units, []*tg.Message{msg})
+	}
+	return units
+}
+
+// groupText returns the matchable text of a message or album: the captions
+// of all parts, one per line.
+func groupText(msgs []*tg.Message) string {
+	if len(msgs) == 1 {
+		return msgs[0].Message
+	}
+	var parts []string
+	for _, m := range msgs {
+		if m.Message != "" {
+			parts = append(parts, m.Message)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// captionIndex returns the album part carrying the caption, or the first one.
+func captionIndex(msgs []*tg.Message) int {
+	for i, m := range msgs {
+		if m.Message != "" {
+			return i
+		}
+	}
+	return 0
+}
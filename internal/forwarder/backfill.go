@@ -0,0 +1,402 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/tg-manager/internal/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// DefaultBackfillLimit is the number of messages scanned when a backfill
+	// has no bounds, such as the one run for a new rule.
+	DefaultBackfillLimit = 50
+	// MaxBackfillLimit caps the number of messages one backfill scans.
+	MaxBackfillLimit = 10000
+
+	backfillPageSize    = 100
+	backfillMaxAttempts = 10
+)
+
+// errJobStopped means the job was cancelled or deleted while it ran.
+var errJobStopped = errors.New("backfill job stopped")
+
+// BackfillOptions select the source history a backfill goes through. Zero
+// values leave a bound open.
+type BackfillOptions struct {
+	Limit         int       // messages to scan, newest first
+	Since         time.Time // only messages posted at or after Since
+	Until         time.Time // only messages posted before Until
+	FromMessageID int       // only messages with this ID or later
+}
+
+// Validate checks that the options are consistent.
+func (o BackfillOptions) Validate() error {
+	if o.Limit < 0 || o.Limit > MaxBackfillLimit {
+		return fmt.Errorf("limit must be between 0 and %d", MaxBackfillLimit)
+	}
+	if o.FromMessageID < 0 {
+		return fmt.Errorf("from_message_id must not be negative")
+	}
+	if !o.Since.IsZero() && !o.Until.IsZero() && !o.Since.Before(o.Until) {
+		return fmt.Errorf("since must be before until")
+	}
+	return nil
+}
+
+// limit returns the number of messages to scan. A scan bounded by a start
+// date or message goes back as far as the cap allows.
+func (o BackfillOptions) limit() int {
+	switch {
+	case o.Limit > 0:
+		return o.Limit
+	case !o.Since.IsZero() || o.FromMessageID > 0:
+		return MaxBackfillLimit
+	default:
+		return DefaultBackfillLimit
+	}
+}
+
+// StartBackfill creates a backfill job for the rule and runs it in the
+// background.
+func (e *Engine) StartBackfill(ruleID uint, opts BackfillOptions) (storage.BackfillJob, error) {
+	job := storage.BackfillJob{
+		RuleID:        ruleID,
+		Limit:         opts.limit(),
+		FromMessageID: opts.FromMessageID,
+		Status:        storage.BackfillRunning,
+	}
+	if !opts.Since.IsZero() {
+		job.Since = &opts.Since
+	}
+	if !opts.Until.IsZero() {
+		job.Until = &opts.Until
+	}
+	if err := e.db.Create(&job).Error; err != nil {
+		return job, fmt.Errorf("create backfill job: %w", err)
+	}
+
+	e.runJob(job)
+	return job, nil
+}
+
+// ResumeBackfills restarts the jobs that were running when the app stopped.
+func (e *Engine) ResumeBackfills() {
+	var jobs []storage.BackfillJob
+	if err := e.db.Where("status = ?", storage.BackfillRunning).Order("id").Find(&jobs).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load backfill jobs")
+		return
+	}
+	for _, job := range jobs {
+		log.Info().Uint("job_id", job.ID).Uint("rule_id", job.RuleID).Int("scanned", job.Scanned).
+			Msg("Resuming backfill")
+		e.runJob(job)
+	}
+}
+
+// CancelBackfill stops a running job and drops the deliveries it queued that
+// have not been sent yet.
+func (e *Engine) CancelBackfill(id uint) error {
+	now := time.Now()
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		// Finished jobs may still have queued deliveries
+		res := tx.Model(&storage.OutboxItem{}).
+			Where("job_id = ? AND status = ?", id, storage.OutboxPending).
+			Update("status", storage.OutboxCancelled)
+		if res.Error != nil {
+			return res.Error
+		}
+		query := tx.Model(&storage.BackfillJob{}).Where("id = ?", id)
+		if res.RowsAffected == 0 {
+			query = query.Where("status = ?", storage.BackfillRunning)
+		}
+		return query.Updates(map[string]interface{}{"status": storage.BackfillCancelled, "finished_at": now}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("cancel backfill job: %w", err)
+	}
+
+	e.jobsMu.Lock()
+	if cancel, ok := e.jobs[id]; ok {
+		cancel()
+	}
+	e.jobsMu.Unlock()
+	return nil
+}
+
+func (e *Engine) runJob(job storage.BackfillJob) {
+	ctx, cancel := context.WithCancel(e.ctx)
+	e.jobsMu.Lock()
+	e.jobs[job.ID] = cancel
+	e.jobsMu.Unlock()
+
+	go func() {
+		defer func() {
+			e.jobsMu.Lock()
+			delete(e.jobs, job.ID)
+			e.jobsMu.Unlock()
+			cancel()
+		}()
+		e.backfill(ctx, job)
+	}()
+}
+
+// backfill goes through the history of the rule's source chat selected by
+// the job, page by page, matches it against the rule, and queues matches in
+// the outbox, where the rule's rate limits apply. Albums are matched and
+// forwarded as one unit. Progress is saved after every page.
+func (e *Engine) backfill(ctx context.Context, job storage.BackfillJob) {
+	logger := log.With().Uint("job_id", job.ID).Uint("rule_id", job.RuleID).Logger()
+
+	var rule storage.ForwardRule
+	if err := e.db.Preload("Targets").First(&rule, job.RuleID).Error; err != nil {
+		e.finishJob(job, fmt.Errorf("load rule: %w", err))
+		return
+	}
+	cr, err := compileRule(rule)
+	if err != nil {
+		e.finishJob(job, err)
+		return
+	}
+	at, ok := cr.admit(time.Now())
+	if !ok {
+		e.finishJob(job, fmt.Errorf("rule is outside of its schedule"))
+		return
+	}
+	if e.apiGetter == nil {
+		e.finishJob(job, fmt.Errorf("API getter not set"))
+		return
+	}
+
+	req := &tg.MessagesGetHistoryRequest{
+		Peer:     sourcePeer(rule),
+		OffsetID: job.Cursor,
+		MinID:    max(job.FromMessageID-1, 0),
+	}
+	if job.Cursor == 0 && job.Until != nil {
+		req.OffsetDate = int(job.Until.Unix())
+	}
+
+	attempts := 0
+	for job.Scanned < job.Limit {
+		req.Limit = backfillPageSize
+		history, err := e.apiGetter().MessagesGetHistory(ctx, req)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			attempts++
+			delay, retry := retryDelay(err, attempts)
+			if !retry || attempts >= backfillMaxAttempts || sleep(ctx, delay) != nil {
+				e.finishJob(job, err)
+				return
+			}
+			logger.Warn().Err(err).Dur("delay", delay).Msg("Backfill: fetching history failed, retrying")
+			continue
+		}
+		attempts = 0
+
+		modified, ok := history.AsModified()
+		if !ok {
+			e.finishJob(job, fmt.Errorf("unexpected history response %T", history))
+			return
+		}
+		page, last := backfillPage(modified.GetMessages(), job)
+		if len(page) == 0 {
+			break
+		}
+
+		ents := newEntities(modified.GetUsers(), modified.GetChats())
+		if err := e.queueBackfillPage(&job, rule, cr, page, ents, at); err != nil {
+			e.finishJob(job, err)
+			return
+		}
+		logger.Debug().Int("scanned", job.Scanned).Int("matched", job.Matched).Msg("Backfill: page done")
+		if last {
+			break
+		}
+		req.OffsetID, req.OffsetDate = job.Cursor, 0
+	}
+
+	e.finishJob(job, nil)
+	logger.Info().Int("scanned", job.Scanned).Int("matched", job.Matched).Int("queued", job.Queued).
+		Msg("Backfill finished")
+}
+
+// backfillPage returns the part of a history page, newest first, that the
+// job still has to scan and whether it ends the scan. The oldest album of a
+// page that continues on the next one is left for that page.
+func backfillPage(history []tg.MessageClass, job storage.BackfillJob) ([]tg.MessageClass, bool) {
+	if len(history) == 0 {
+		return nil, true
+	}
+
+	page := history
+	last := false
+	for i, m := range history {
+		if d := messageDate(m); job.Since != nil && !d.IsZero() && d.Before(*job.Since) {
+			page, last = history[:i], true
+			break
+		}
+	}
+	if n := job.Limit - job.Scanned; len(page) > n {
+		// Finish the album at the cut
+		for n < len(page) && n > 0 && groupedID(page[n]) != 0 && groupedID(page[n]) == groupedID(page[n-1]) {
+			n++
+		}
+		page, last = page[:n], true
+	}
+	if last {
+		return page, true
+	}
+
+	if g := groupedID(page[len(page)-1]); g != 0 {
+		n := len(page)
+		for n > 0 && groupedID(page[n-1]) == g {
+			n--
+		}
+		if n > 0 {
+			page = page[:n]
+		}
+	}
+	return page, false
+}
+
+// queueBackfillPage matches one page of history and, in one transaction,
+// queues the matches and saves the job's progress.
+func (e *Engine) queueBackfillPage(job *storage.BackfillJob, rule storage.ForwardRule, cr *compiledRule, page []tg.MessageClass, ents entities, at time.Time) error {
+	var (
+		items   []storage.OutboxItem
+		entries []storage.DigestEntry
+		matched int
+	)
+	for _, unit := range groupAlbums(page) {
+		snd := ents.senderOf(unit[0])
+		if !cr.match(unit, snd) {
+			continue
+		}
+		matched++
+		if rule.DeliveryMode == storage.DeliveryModeDigest {
+			entries = append(entries, newDigestEntry(rule, unit, snd))
+			continue
+		}
+		for _, target := range rule.Targets {
+			pending := e.notForwarded(rule.ID, target.ID, unit)
+			if len(pending) == 0 {
+				continue
+			}
+			item, err := newOutboxItem(rule.ID, target.ID, pending, snd)
+			if err != nil {
+				return err
+			}
+			item.NextAttemptAt, item.JobID = at, job.ID
+			items = append(items, item)
+		}
+	}
+
+	next := *job
+	next.Cursor = page[len(page)-1].GetID()
+	next.Scanned += len(page)
+	next.Matched += matched
+
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if len(items) > 0 {
+			res := tx.Clauses(requeue).Create(&items)
+			if res.Error != nil {
+				return fmt.Errorf("enqueue deliveries: %w", res.Error)
+			}
+			next.Queued += int(res.RowsAffected)
+		}
+		if len(entries) > 0 {
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entries)
+			if res.Error != nil {
+				return fmt.Errorf("collect digest entries: %w", res.Error)
+			}
+			next.Queued += int(res.RowsAffected)
+		}
+		res := tx.Model(&storage.BackfillJob{}).
+			Where("id = ? AND status = ?", job.ID, storage.BackfillRunning).
+			Updates(map[string]interface{}{
+				"cursor":  next.Cursor,
+				"scanned": next.Scanned,
+				"matched": next.Matched,
+				"queued":  next.Queued,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errJobStopped
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	*job = next
+	e.wakeOutbox()
+	return nil
+}
+
+// finishJob records the outcome of a job that is still running.
+func (e *Engine) finishJob(job storage.BackfillJob, err error) {
+	if errors.Is(err, errJobStopped) {
+		return
+	}
+
+	status, errText := storage.BackfillDone, ""
+	level := zerolog.InfoLevel
+	if err != nil {
+		status, errText, level = storage.BackfillFailed, err.Error(), zerolog.ErrorLevel
+	}
+	log.WithLevel(level).Err(err).Uint("job_id", job.ID).Uint("rule_id", job.RuleID).
+		Str("status", status).Msg("Backfill job ended")
+
+	dbErr := e.db.Model(&storage.BackfillJob{}).
+		Where("id = ? AND status = ?", job.ID, storage.BackfillRunning).
+		Updates(map[string]interface{}{
+			"status":      status,
+			"error":       errText,
+			"finished_at": time.Now(),
+		}).Error
+	if dbErr != nil {
+		log.Error().Err(dbErr).Uint("job_id", job.ID).Msg("Failed to record backfill result")
+	}
+}
+
+func groupedID(m tg.MessageClass) int64 {
+	if msg, ok := m.(*tg.Message); ok {
+		return msg.GroupedID
+	}
+	return 0
+}
+
+func messageDate(m tg.MessageClass) time.Time {
+	switch m := m.(type) {
+	case *tg.Message:
+		return time.Unix(int64(m.Date), 0)
+	case *tg.MessageService:
+		return time.Unix(int64(m.Date), 0)
+	}
+	return time.Time{}
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
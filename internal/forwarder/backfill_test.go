@@ -0,0 +1,216 @@
+package forwarder
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB connects to the Postgres database named by TG_MANAGER_TEST_DSN and
+// migrates it. Tests that need a database are skipped without one.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TG_MANAGER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TG_MANAGER_TEST_DSN not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.NewStorage(db).AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBackfillRerunAfterCancel(t *testing.T) {
+	db := testDB(t)
+	e := NewEngine(db)
+
+	rule := storage.ForwardRule{
+		SourceType:      storage.PeerTypeChannel,
+		SourceChannelID: time.Now().UnixNano(),
+		DeliveryMode:    storage.DeliveryModeForward,
+		Targets:         []storage.ForwardTarget{{TargetType: storage.PeerTypeSelf}},
+	}
+	if err := db.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.OutboxItem{})
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.BackfillJob{})
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.ForwardTarget{})
+		db.Delete(&rule)
+	})
+	cr, err := compileRule(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := []tg.MessageClass{
+		&tg.Message{ID: 2, Message: "two", Date: int(time.Now().Unix())},
+		&tg.Message{ID: 1, Message: "one", Date: int(time.Now().Unix())},
+	}
+	run := func() storage.BackfillJob {
+		t.Helper()
+		job := storage.BackfillJob{RuleID: rule.ID, Status: storage.BackfillRunning}
+		if err := db.Create(&job).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := e.queueBackfillPage(&job, rule, cr, page, entities{}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if job.Queued != len(page) {
+			t.Fatalf("job %d queued %d, want %d", job.ID, job.Queued, len(page))
+		}
+		return job
+	}
+	pending := func(job storage.BackfillJob) {
+		t.Helper()
+		var items []storage.OutboxItem
+		db.Where("rule_id = ?", rule.ID).Find(&items)
+		if len(items) != len(page) {
+			t.Fatalf("%d outbox items, want %d", len(items), len(page))
+		}
+		for _, item := range items {
+			if item.Status != storage.OutboxPending || item.JobID != job.ID || item.Attempts != 0 || item.LastError != "" {
+				t.Errorf("item %d: status %q, job %d, attempts %d, error %q; want pending for job %d",
+					item.MessageID, item.Status, item.JobID, item.Attempts, item.LastError, job.ID)
+			}
+		}
+	}
+
+	first := run()
+	pending(first)
+	if err := e.CancelBackfill(first.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	second := run()
+	pending(second)
+
+	// Deliveries that failed for good are queued again too, with the same
+	// random IDs in case an attempt got through
+	randomIDs := func() map[int][]int64 {
+		var items []storage.OutboxItem
+		db.Where("rule_id = ?", rule.ID).Find(&items)
+		ids := make(map[int][]int64)
+		for _, item := range items {
+			ids[item.MessageID] = item.RandomIDs
+		}
+		return ids
+	}
+	before := randomIDs()
+	db.Model(&storage.OutboxItem{}).Where("rule_id = ?", rule.ID).
+		Updates(map[string]interface{}{"status": storage.OutboxFailed, "attempts": 3, "last_error": "CHAT_WRITE_FORBIDDEN"})
+	pending(run())
+	for id, ids := range randomIDs() {
+		if !slices.Equal(ids, before[id]) {
+			t.Errorf("message %d: random IDs %v, want %v", id, ids, before[id])
+		}
+	}
+
+	// Queued deliveries are left alone
+	job := storage.BackfillJob{RuleID: rule.ID, Status: storage.BackfillRunning}
+	db.Create(&job)
+	if err := e.queueBackfillPage(&job, rule, cr, page, entities{}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if job.Queued != 0 {
+		t.Fatalf("queued %d deliveries that were pending already", job.Queued)
+	}
+}
+
+func TestBackfillPage(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	since := now.Add(-time.Hour)
+	// msg is a message posted age ago, in album g unless g is 0
+	msg := func(id int, g int64, age time.Duration) tg.MessageClass {
+		return &tg.Message{ID: id, GroupedID: g, Date: int(now.Add(-age).Unix())}
+	}
+	tests := []struct {
+		name     string
+		history  []tg.MessageClass
+		job      storage.BackfillJob
+		wantIDs  []int
+		wantLast bool
+	}{
+		{
+			name:     "empty history",
+			job:      storage.BackfillJob{Limit: 10},
+			wantLast: true,
+		},
+		{
+			name:    "no albums",
+			history: []tg.MessageClass{msg(3, 0, 0), msg(2, 0, 0), msg(1, 0, 0)},
+			job:     storage.BackfillJob{Limit: 10},
+			wantIDs: []int{3, 2, 1},
+		},
+		{
+			name:    "album across the page boundary is left for the next page",
+			history: []tg.MessageClass{msg(6, 0, 0), msg(5, 0, 0), msg(4, 7, 0), msg(3, 7, 0)},
+			job:     storage.BackfillJob{Limit: 10},
+			wantIDs: []int{6, 5},
+		},
+		{
+			name:    "album ending before the page boundary is kept",
+			history: []tg.MessageClass{msg(6, 7, 0), msg(5, 7, 0), msg(4, 0, 0)},
+			job:     storage.BackfillJob{Limit: 10},
+			wantIDs: []int{6, 5, 4},
+		},
+		{
+			name:    "page of a single album is kept",
+			history: []tg.MessageClass{msg(3, 7, 0), msg(2, 7, 0), msg(1, 7, 0)},
+			job:     storage.BackfillJob{Limit: 10},
+			wantIDs: []int{3, 2, 1},
+		},
+		{
+			name:     "limit inside an album finishes the album",
+			history:  []tg.MessageClass{msg(5, 0, 0), msg(4, 7, 0), msg(3, 7, 0), msg(2, 7, 0), msg(1, 0, 0)},
+			job:      storage.BackfillJob{Limit: 2},
+			wantIDs:  []int{5, 4, 3, 2},
+			wantLast: true,
+		},
+		{
+			name:     "limit at an album start",
+			history:  []tg.MessageClass{msg(5, 0, 0), msg(4, 0, 0), msg(3, 7, 0), msg(2, 7, 0)},
+			job:      storage.BackfillJob{Limit: 2},
+			wantIDs:  []int{5, 4},
+			wantLast: true,
+		},
+		{
+			name:     "limit counts messages scanned on earlier pages",
+			history:  []tg.MessageClass{msg(5, 0, 0), msg(4, 7, 0), msg(3, 7, 0), msg(2, 0, 0)},
+			job:      storage.BackfillJob{Limit: 10, Scanned: 8},
+			wantIDs:  []int{5, 4, 3},
+			wantLast: true,
+		},
+		{
+			name:     "since ends the scan",
+			history:  []tg.MessageClass{msg(5, 0, 0), msg(4, 7, time.Minute), msg(3, 7, 2*time.Hour), msg(2, 0, 2*time.Hour)},
+			job:      storage.BackfillJob{Limit: 10, Since: &since},
+			wantIDs:  []int{5, 4},
+			wantLast: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, last := backfillPage(tt.history, tt.job)
+			var ids []int
+			for _, m := range page {
+				ids = append(ids, m.GetID())
+			}
+			if !slices.Equal(ids, tt.wantIDs) || last != tt.wantLast {
+				t.Errorf("backfillPage = %v, last %v; want %v, last %v", ids, last, tt.wantIDs, tt.wantLast)
+			}
+		})
+	}
+}
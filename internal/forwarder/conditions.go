@@ -0,0 +1,92 @@
+package forwarder
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/tg-manager/internal/storage"
+)
+
+// compiledConditions holds the compiled regexes of storage.RuleConditions.
+// Keywords are compiled to regexes as well.
+type compiledConditions struct {
+	all, any, none   []*regexp.Regexp
+	keywords, denied []*regexp.Regexp
+}
+
+func compileConditions(cond storage.RuleConditions) (compiledConditions, error) {
+	var c compiledConditions
+	flags := ""
+	if cond.IgnoreCase {
+		flags = "(?i)"
+	}
+
+	groups := []struct {
+		name     string
+		patterns []string
+		dst      *[]*regexp.Regexp
+	}{
+		{"all", cond.All, &c.all},
+		{"any", cond.Any, &c.any},
+		{"none", cond.None, &c.none},
+	}
+	for _, g := range groups {
+		for i, p := range g.patterns {
+			re, err := regexp.Compile(flags + p)
+			if err != nil {
+				return c, fmt.Errorf("conditions.%s #%d: %w", g.name, i+1, err)
+			}
+			*g.dst = append(*g.dst, re)
+		}
+	}
+
+	c.keywords = compileKeywords(cond.Keywords, flags, cond.WholeWord)
+	c.denied = compileKeywords(cond.ExcludeKeywords, flags, cond.WholeWord)
+	return c, nil
+}
+
+// compileKeywords turns plain keywords into regexes. Word boundaries are
+// Unicode-aware, unlike \b.
+func compileKeywords(keywords []string, flags string, wholeWord bool) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, k := range keywords {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		expr := regexp.QuoteMeta(k)
+		if wholeWord {
+			expr = `(?:^|[^\pL\pN_])` + expr + `(?:$|[^\pL\pN_])`
+		}
+		res = append(res, regexp.MustCompile(flags+expr))
+	}
+	return res
+}
+
+func (c compiledConditions) match(text string) bool {
+	matches := func(re *regexp.Regexp) bool { return re.MatchString(text) }
+
+	for _, re := range c.all {
+		if !re.MatchString(text) {
+			return false
+		}
+	}
+	if len(c.any) > 0 && !slices.ContainsFunc(c.any, matches) {
+		return false
+	}
+	if slices.ContainsFunc(c.none, matches) {
+		return false
+	}
+	if len(c.keywords) > 0 && !slices.ContainsFunc(c.keywords, matches) {
+		return false
+	}
+	return !slices.ContainsFunc(c.denied, matches)
+}
+
+// hasConditions reports whether any structured condition is set.
+func hasConditions(cond storage.RuleConditions) bool {
+	return len(cond.All) > 0 || len(cond.Any) > 0 || len(cond.None) > 0 ||
+		len(cond.Keywords) > 0 || len(cond.ExcludeKeywords) > 0
+}
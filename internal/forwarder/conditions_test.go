@@ -0,0 +1,102 @@
+package forwarder
+
+import (
+	"testing"
+
+	"github.com/tg-manager/internal/storage"
+)
+
+func TestConditionsMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		cond storage.RuleConditions
+		text string
+		want bool
+	}{
+		{name: "empty matches anything", text: "hello", want: true},
+		{name: "empty matches empty text", text: "", want: true},
+		{
+			name: "empty groups match anything",
+			cond: storage.RuleConditions{All: []string{}, Any: []string{}, None: []string{}, Keywords: []string{"", " "}},
+			text: "hello", want: true,
+		},
+
+		// All is an AND of its regexes
+		{name: "all of one", cond: storage.RuleConditions{All: []string{"foo"}}, text: "foo bar", want: true},
+		{name: "all of both", cond: storage.RuleConditions{All: []string{"foo", "bar"}}, text: "foo bar", want: true},
+		{name: "all missing one", cond: storage.RuleConditions{All: []string{"foo", "baz"}}, text: "foo bar", want: false},
+
+		// Any is an OR of its regexes
+		{name: "any first", cond: storage.RuleConditions{Any: []string{"foo", "baz"}}, text: "foo bar", want: true},
+		{name: "any second", cond: storage.RuleConditions{Any: []string{"baz", "bar"}}, text: "foo bar", want: true},
+		{name: "any of none", cond: storage.RuleConditions{Any: []string{"baz", "qux"}}, text: "foo bar", want: false},
+
+		// Groups are ANDed together
+		{
+			name: "all and any",
+			cond: storage.RuleConditions{All: []string{"foo"}, Any: []string{"bar", "baz"}},
+			text: "foo bar", want: true,
+		},
+		{
+			name: "all but not any",
+			cond: storage.RuleConditions{All: []string{"foo"}, Any: []string{"baz", "qux"}},
+			text: "foo bar", want: false,
+		},
+		{
+			name: "any but not all",
+			cond: storage.RuleConditions{All: []string{"qux"}, Any: []string{"foo"}},
+			text: "foo bar", want: false,
+		},
+
+		// None and ExcludeKeywords negate
+		{name: "none absent", cond: storage.RuleConditions{None: []string{"spam"}}, text: "foo bar", want: true},
+		{name: "none present", cond: storage.RuleConditions{None: []string{"qux", "bar"}}, text: "foo bar", want: false},
+		{
+			name: "all and none present",
+			cond: storage.RuleConditions{All: []string{"foo"}, None: []string{"bar"}},
+			text: "foo bar", want: false,
+		},
+		{
+			name: "excluded keyword overrides keyword",
+			cond: storage.RuleConditions{Keywords: []string{"sale"}, ExcludeKeywords: []string{"ad"}},
+			text: "sale ad", want: false,
+		},
+		{name: "excluded keyword absent", cond: storage.RuleConditions{ExcludeKeywords: []string{"ad"}}, text: "news", want: true},
+
+		// Keywords are an OR of plain text
+		{name: "keyword", cond: storage.RuleConditions{Keywords: []string{"a.b", "sale"}}, text: "big sale", want: true},
+		{name: "keyword is not a regex", cond: storage.RuleConditions{Keywords: []string{"a.b"}}, text: "axb", want: false},
+		{name: "keyword case", cond: storage.RuleConditions{Keywords: []string{"Sale"}}, text: "big sale", want: false},
+		{
+			name: "keyword ignore case",
+			cond: storage.RuleConditions{Keywords: []string{"Sale"}, IgnoreCase: true},
+			text: "big SALE", want: true,
+		},
+		{
+			name: "keyword whole word",
+			cond: storage.RuleConditions{Keywords: []string{"sale"}, WholeWord: true},
+			text: "wholesale", want: false,
+		},
+		{
+			name: "keyword whole word in non-latin text",
+			cond: storage.RuleConditions{Keywords: []string{"新闻"}, WholeWord: true},
+			text: "今日 新闻，", want: true,
+		},
+		{
+			name: "ignore case applies to regexes",
+			cond: storage.RuleConditions{All: []string{"FOO"}, None: []string{"BAR"}, IgnoreCase: true},
+			text: "foo bar", want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := compileConditions(tt.cond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.match(tt.text); got != tt.want {
+				t.Errorf("match(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package forwarder
+
+import (
+	"context"
+
+	"github.com/gotd/td/tg"
+)
+
+// copyMessages copies a single message or an album to its placement in the
+// target. Albums are re-sent as one grouped media message; if
+// any part cannot be re-sent by reference, the album is forwarded without
+// the author header instead.
+func copyMessages(ctx context.Context, api *tg.Client, from, to tg.InputPeerClass, at placement, msgs []*tg.Message, randomIDs []int64) (tg.UpdatesClass, error) {
+	if len(msgs) == 1 {
+		return copyMessage(ctx, api, from, to, at, msgs[0], randomIDs[0])
+	}
+
+	multi := make([]tg.InputSingleMedia, 0, len(msgs))
+	for i, m := range msgs {
+		media, ok := inputMedia(m.Media)
+		if !ok || media == nil {
+			ids := make([]int, 0, len(msgs))
+			for _, m := range msgs {
+				ids = append(ids, m.ID)
+			}
+			return api.MessagesForwardMessages(ctx, &tg.MessagesForwardMessagesRequest{
+				FromPeer:   from,
+				ToPeer:     to,
+				ID:         ids,
+				RandomID:   randomIDs,
+				DropAuthor: true,
+				TopMsgID:   at.topMsgID(),
+			})
+		}
+		multi = append(multi, tg.InputSingleMedia{
+			Media:    media,
+			RandomID: randomIDs[i],
+			Message:  m.Message,
+			Entities: m.Entities,
+		})
+	}
+
+	return api.MessagesSendMultiMedia(ctx, &tg.MessagesSendMultiMediaRequest{
+		Peer:       to,
+		ReplyTo:    at.inputReplyTo(),
+		MultiMedia: multi,
+	})
+}
+
+// copyMessage re-sends msg into the target peer as a new message, so the
+// result carries no "Forwarded from" header. Formatting entities are kept and
+// photos/documents are sent by reference, without re-uploading.
+func copyMessage(ctx context.Context, api *tg.Client, from, to tg.InputPeerClass, at placement, msg *tg.Message, randomID int64) (tg.UpdatesClass, error) {
+	media, ok := inputMedia(msg.Media)
+	if !ok {
+		// Polls, geo points, contacts etc. cannot be re-sent by reference;
+		// forwarding without the author header is the closest equivalent.
+		return api.MessagesForwardMessages(ctx, &tg.MessagesForwardMessagesRequest{
+			FromPeer:   from,
+			ToPeer:     to,
+			ID:         []int{msg.ID},
+			RandomID:   []int64{randomID},
+			DropAuthor: true,
+			TopMsgID:   at.topMsgID(),
+		})
+	}
+
+	if media == nil {
+		_, hasPreview := msg.Media.(*tg.MessageMediaWebPage)
+		return api.MessagesSendMessage(ctx, &tg.MessagesSendMessageRequest{
+			Peer:      to,
+			ReplyTo:   at.inputReplyTo(),
+			Message:   msg.Message,
+			Entities:  msg.Entities,
+			NoWebpage: !hasPreview,
+			RandomID:  randomID,
+		})
+	}
+
+	return api.MessagesSendMedia(ctx, &tg.MessagesSendMediaRequest{
+		Peer:        to,
+		ReplyTo:     at.inputReplyTo(),
+		Media:       media,
+		Message:     msg.Message,
+		Entities:    msg.Entities,
+		InvertMedia: msg.InvertMedia,
+		RandomID:    randomID,
+	})
+}
+
+// inputMedia converts message media into its input form for re-sending.
+// It returns (nil, true) when the message should be sent as plain text
+// (no media, or a link preview that Telegram regenerates by itself) and
+// (nil, false) when the media type cannot be re-sent.
+func inputMedia(media tg.MessageMediaClass) (tg.InputMediaClass, bool) {
+	switch m := media.(type) {
+	case nil, *tg.MessageMediaEmpty, *tg.MessageMediaWebPage:
+		return nil, true
+	case *tg.MessageMediaPhoto:
+		photo, ok := m.Photo.(*tg.Photo)
+		if !ok {
+			return nil, false
+		}
+		return &tg.InputMediaPhoto{
+			Spoiler: m.Spoiler,
+			ID: &tg.InputPhoto{
+				ID:            photo.ID,
+				AccessHash:    photo.AccessHash,
+				FileReference: photo.FileReference,
+			},
+		}, true
+	case *tg.MessageMediaDocument:
+		doc, ok := m.Document.(*tg.Document)
+		if !ok {
+			return nil, false
+		}
+		return &tg.InputMediaDocument{
+			Spoiler: m.Spoiler,
+			ID: &tg.InputDocument{
+				ID:            doc.ID,
+				AccessHash:    doc.AccessHash,
+				FileReference: doc.FileReference,
+			},
+		}, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,143 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/rs/zerolog/log"
+	"github.com/tg-manager/internal/storage"
+)
+
+// handleDelete processes messages deleted in a source channel. For rules with
+// SyncDeletes, deliveries that have not been sent yet are cancelled and the
+// delivered messages are deleted from the targets. Deletions in basic groups
+// and private chats carry no chat (channelID 0): their message IDs are unique
+// per account, so they apply to all rules with such a source.
+func (e *Engine) handleDelete(channelID int64, ids []int) {
+	if len(ids) == 0 {
+		return
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var items []storage.OutboxItem
+	for _, rule := range e.rules {
+		if !rule.SyncDeletes {
+			continue
+		}
+		if channelID != 0 && !(peerRef{typ: storage.PeerTypeChannel, id: channelID}).isSourceOf(rule) {
+			continue
+		}
+		if channelID == 0 && isChannel(rule.SourceType) {
+			continue
+		}
+
+		if rule.DeliveryMode == storage.DeliveryModeDigest {
+			// Posted digests stay as they are
+			err := e.db.Where("rule_id = ? AND digested_at IS NULL AND message_id IN ?", rule.ID, ids).
+				Delete(&storage.DigestEntry{}).Error
+			if err != nil {
+				log.Error().Err(err).Uint("rule_id", rule.ID).Msg("Failed to drop digest entries of deleted messages")
+			}
+			continue
+		}
+
+		err := e.db.Model(&storage.OutboxItem{}).
+			Where("rule_id = ? AND status = ? AND action <> ?", rule.ID, storage.OutboxPending, storage.OutboxActionDelete).
+			Where("EXISTS (SELECT 1 FROM jsonb_array_elements_text(message_ids) AS m(id) WHERE m.id::int IN ?)", ids).
+			Updates(map[string]interface{}{
+				"status":     storage.OutboxCancelled,
+				"last_error": "source message deleted",
+			}).Error
+		if err != nil {
+			log.Error().Err(err).Uint("rule_id", rule.ID).Msg("Failed to cancel deliveries of deleted messages")
+		}
+
+		// Deliveries in flight are covered too: the delete is queued behind
+		// them and runs once they are done.
+		for _, target := range rule.Targets {
+			// Webhook deliveries cannot be taken back
+			if target.TargetType == storage.PeerTypeWebhook || !e.hasDeliveries(rule.ID, target.ID, ids) {
+				continue
+			}
+			items = append(items, storage.OutboxItem{
+				RuleID:        rule.ID,
+				TargetID:      target.ID,
+				MessageID:     ids[0],
+				MessageIDs:    ids,
+				Action:        storage.OutboxActionDelete,
+				Payload:       []byte{},
+				Status:        storage.OutboxPending,
+				NextAttemptAt: time.Now(),
+			})
+		}
+	}
+
+	if err := e.enqueue(items); err != nil {
+		log.Error().Err(err).Int64("source", channelID).Ints("message_ids", ids).
+			Msg("Failed to queue deletion")
+	}
+}
+
+// hasDeliveries reports whether any of the messages was sent, or is being
+// sent, to the target.
+func (e *Engine) hasDeliveries(ruleID, targetID uint, ids []int) bool {
+	var count int64
+	e.db.Model(&storage.MessageMapping{}).
+		Where("rule_id = ? AND target_id = ? AND source_message_id IN ?", ruleID, targetID, ids).
+		Count(&count)
+	if count > 0 {
+		return true
+	}
+
+	e.db.Model(&storage.OutboxItem{}).
+		Where("rule_id = ? AND target_id = ? AND status = ?", ruleID, targetID, storage.OutboxSending).
+		Where("EXISTS (SELECT 1 FROM jsonb_array_elements_text(message_ids) AS m(id) WHERE m.id::int IN ?)", ids).
+		Count(&count)
+	return count > 0
+}
+
+// deleteCopies deletes the messages delivered to the target for the given
+// source messages.
+func (e *Engine) deleteCopies(ctx context.Context, ids []int, rule storage.ForwardRule, target storage.ForwardTarget) error {
+	if e.apiGetter == nil {
+		return fmt.Errorf("API getter not set, cannot delete")
+	}
+
+	var mappings []storage.MessageMapping
+	err := e.db.Where("rule_id = ? AND target_id = ? AND source_message_id IN ?", rule.ID, target.ID, ids).
+		Find(&mappings).Error
+	if err != nil {
+		return err
+	}
+	if len(mappings) == 0 {
+		return nil
+	}
+
+	targetIDs := make([]int, 0, len(mappings))
+	for _, m := range mappings {
+		targetIDs = append(targetIDs, m.TargetMessageID)
+	}
+	api := e.apiGetter()
+	if isChannel(target.TargetType) {
+		_, err = api.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{
+			Channel: &tg.InputChannel{
+				ChannelID:  target.TargetChannelID,
+				AccessHash: target.TargetHash,
+			},
+			ID: targetIDs,
+		})
+	} else {
+		_, err = api.MessagesDeleteMessages(ctx, &tg.MessagesDeleteMessagesRequest{
+			Revoke: true,
+			ID:     targetIDs,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return e.db.Delete(&mappings).Error
+}
@@ -0,0 +1,266 @@
+package forwarder
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/tg-manager/internal/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	digestPollInterval = time.Minute
+	defaultDigestItems = 30
+	digestLineLength   = 100  // runes per entry
+	digestMaxLength    = 4000 // runes per post; Telegram allows 4096
+)
+
+// compiledDigest is the parsed posting schedule of a digest rule.
+type compiledDigest struct {
+	interval time.Duration
+	at       []int // minutes of the day, sorted
+}
+
+func compileDigest(cfg storage.DigestConfig) (*compiledDigest, error) {
+	if cfg.Interval < 0 || cfg.MaxItems < 0 {
+		return nil, fmt.Errorf("digest interval and max_items must not be negative")
+	}
+	if cfg.Interval == 0 && len(cfg.At) == 0 {
+		return nil, fmt.Errorf("digest requires an interval or posting times")
+	}
+
+	d := &compiledDigest{interval: time.Duration(cfg.Interval) * time.Minute}
+	for _, s := range cfg.At {
+		m, err := parseClock(s)
+		if err != nil {
+			return nil, fmt.Errorf("digest time: %w", err)
+		}
+		d.at = append(d.at, m)
+	}
+	slices.Sort(d.at)
+	return d, nil
+}
+
+// next returns the first posting time after t. Intervals are aligned to
+// multiples of the interval, so an hourly digest posts on the hour.
+func (d *compiledDigest) next(t time.Time, loc *time.Location) time.Time {
+	if len(d.at) == 0 {
+		return t.Truncate(d.interval).Add(d.interval)
+	}
+	t = t.In(loc)
+	for day := 0; day <= 1; day++ {
+		for _, m := range d.at {
+			at := time.Date(t.Year(), t.Month(), t.Day()+day, m/60, m%60, 0, 0, loc)
+			if at.After(t) {
+				return at
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// newDigestEntry summarises a matched message or album for the digest.
+func newDigestEntry(rule storage.ForwardRule, msgs []*tg.Message, snd sender) storage.DigestEntry {
+	text, _, _ := strings.Cut(strings.TrimSpace(groupText(msgs)), "\n")
+	if text == "" {
+		text = "[" + describeMedia(msgs[0]).kind + "]"
+	}
+	if r := []rune(text); len(r) > digestLineLength {
+		text = string(r[:digestLineLength]) + "…"
+	}
+	return storage.DigestEntry{
+		RuleID:     rule.ID,
+		MessageID:  msgs[0].ID,
+		Text:       text,
+		Link:       messageLink(rule, msgs[0].ID),
+		SenderName: snd.name,
+		PostedAt:   time.Unix(int64(msgs[0].Date), 0),
+	}
+}
+
+// collectDigest stores matches for the next digest post. Matches that are
+// already collected are ignored.
+func (e *Engine) collectDigest(entries []storage.DigestEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := e.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&entries).Error; err != nil {
+		return fmt.Errorf("collect digest entries: %w", err)
+	}
+	return nil
+}
+
+func (e *Engine) runDigests() {
+	ticker := time.NewTicker(digestPollInterval)
+	defer ticker.Stop()
+
+	for {
+		e.processDigests(time.Now())
+		select {
+		case <-ticker.C:
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// processDigests posts the digests that are due: those whose oldest
+// collected entry is older than the last posting time.
+func (e *Engine) processDigests(now time.Time) {
+	e.mu.RLock()
+	var due []*compiledRule
+	for _, cr := range e.compiled {
+		if cr.digest != nil {
+			due = append(due, cr)
+		}
+	}
+	e.mu.RUnlock()
+
+	for _, cr := range due {
+		var oldest storage.DigestEntry
+		err := e.db.Where("rule_id = ? AND digested_at IS NULL", cr.rule.ID).
+			Order("created_at").Limit(1).Find(&oldest).Error
+		if err != nil {
+			log.Error().Err(err).Uint("rule_id", cr.rule.ID).Msg("Failed to load digest entries")
+			continue
+		}
+		if oldest.ID == 0 || now.Before(cr.digest.next(oldest.CreatedAt, cr.schedule.loc)) {
+			continue
+		}
+		if err := e.queueDigest(cr.rule, now); err != nil {
+			log.Error().Err(err).Uint("rule_id", cr.rule.ID).Msg("Failed to queue digest")
+		}
+	}
+}
+
+// queueDigest turns the collected entries of the rule into one digest post
+// per target and queues the posts in the outbox.
+func (e *Engine) queueDigest(rule storage.ForwardRule, now time.Time) error {
+	var entries []storage.DigestEntry
+	err := e.db.Where("rule_id = ? AND digested_at IS NULL", rule.ID).Order("message_id").Find(&entries).Error
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	text := digestText(rule, entries)
+	ids := make([]int, 0, len(entries))
+	entryIDs := make([]uint, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.MessageID)
+		entryIDs = append(entryIDs, entry.ID)
+	}
+
+	var items []storage.OutboxItem
+	for _, target := range rule.Targets {
+		items = append(items, storage.OutboxItem{
+			RuleID:        rule.ID,
+			TargetID:      target.ID,
+			MessageID:     ids[len(ids)-1],
+			MessageIDs:    ids,
+			RandomIDs:     newRandomIDs(1),
+			Action:        storage.OutboxActionDigest,
+			Payload:       []byte(text),
+			Status:        storage.OutboxPending,
+			NextAttemptAt: now,
+		})
+	}
+
+	err = e.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(requeue).Create(&items).Error; err != nil {
+			return err
+		}
+		return tx.Model(&storage.DigestEntry{}).Where("id IN ?", entryIDs).Update("digested_at", now).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().Uint("rule_id", rule.ID).Int("entries", len(entries)).Msg("Digest queued")
+	e.wakeOutbox()
+	return nil
+}
+
+// digestText renders a digest post: a title with the number of matches and
+// one line per match with a link to the original, as far as they fit.
+func digestText(rule storage.ForwardRule, entries []storage.DigestEntry) string {
+	maxItems := cmp.Or(rule.Digest.MaxItems, defaultDigestItems)
+	title := cmp.Or(rule.Digest.Title, rule.SourceName, "Digest")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%d)\n", title, len(entries))
+	length := len([]rune(b.String()))
+
+	listed := 0
+	for i, entry := range entries {
+		line := fmt.Sprintf("\n%d. %s", i+1, entry.Text)
+		if entry.SenderName != "" {
+			line += " — " + entry.SenderName
+		}
+		if entry.Link != "" {
+			line += "\n" + entry.Link
+		}
+		n := len([]rune(line))
+		if listed == maxItems || length+n > digestMaxLength {
+			break
+		}
+		b.WriteString(line)
+		length += n
+		listed++
+	}
+	if rest := len(entries) - listed; rest > 0 {
+		fmt.Fprintf(&b, "\n\n… and %d more", rest)
+	}
+	return b.String()
+}
+
+// deliverDigest posts a queued digest to the target.
+func (e *Engine) deliverDigest(logger zerolog.Logger, item storage.OutboxItem, rule storage.ForwardRule, target storage.ForwardTarget) {
+	logger.Info().Int64("target", target.TargetChannelID).Int("entries", len(item.MessageIDs)).
+		Int("attempt", item.Attempts+1).Msg("Posting digest")
+
+	err := e.postDigest(e.ctx, item, rule, target)
+	if tgerr.Is(err, "RANDOM_ID_DUPLICATE") {
+		logger.Warn().Msg("Digest was already posted by an earlier attempt")
+		err = nil
+	}
+	if err == nil {
+		err = e.completeOutbox(item, rule, target, nil, nil, "")
+		if err == nil {
+			return
+		}
+	}
+	e.retryOutbox(item, rule, target, nil, err)
+}
+
+func (e *Engine) postDigest(ctx context.Context, item storage.OutboxItem, rule storage.ForwardRule, target storage.ForwardTarget) error {
+	if target.TargetType == storage.PeerTypeWebhook {
+		return e.postWebhook(ctx, target, webhookPayload{
+			Event:      webhookEventDigest,
+			DeliveryID: item.ID,
+			RuleID:     rule.ID,
+			Source:     webhookSource{ID: rule.SourceChannelID, Type: rule.SourceType, Name: rule.SourceName},
+			Digest:     string(item.Payload),
+		})
+	}
+	if e.apiGetter == nil {
+		return fmt.Errorf("API getter not set, cannot post digest")
+	}
+	defer e.sending(item.RandomIDs)()
+	_, err := e.apiGetter().MessagesSendMessage(ctx, &tg.MessagesSendMessageRequest{
+		Peer:      targetPeer(target),
+		ReplyTo:   placement{topic: target.TopicID}.inputReplyTo(),
+		Message:   string(item.Payload),
+		NoWebpage: true,
+		RandomID:  item.RandomIDs[0],
+	})
+	return err
+}
@@ -0,0 +1,150 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+// Number of source posts a dry run looks at by default and at most.
+const (
+	DefaultTestLimit = 20
+	MaxTestLimit     = 100
+)
+
+// TestResult is the outcome of a dry run: how a candidate rule and the
+// enabled rules treat sample text or the latest posts of a source.
+type TestResult struct {
+	Scanned  int           `json:"scanned"`
+	Matched  int           `json:"matched"`
+	Messages []TestMessage `json:"messages"` // newest first
+}
+
+// TestMessage is a post or album of a dry run.
+type TestMessage struct {
+	MessageID  int               `json:"message_id,omitempty"` // 0 for sample text
+	Date       *time.Time        `json:"date,omitempty"`
+	Text       string            `json:"text"`
+	SenderName string            `json:"sender_name,omitempty"`
+	Matched    bool              `json:"matched"` // by the candidate
+	Groups     map[string]string `json:"groups,omitempty"`
+	Rules      []uint            `json:"rules"` // enabled rules that match it
+}
+
+// compileCandidate validates and compiles the matching options of a rule
+// under test. Its targets and delivery settings do not matter.
+func compileCandidate(rule storage.ForwardRule) (*compiledRule, error) {
+	rule.DeliveryMode = storage.DeliveryModeForward
+	rule.Targets = []storage.ForwardTarget{{TargetType: storage.PeerTypeSelf}}
+	rule.Replacements, rule.PrefixTemplate, rule.SuffixTemplate = nil, "", ""
+	if rule.SourceType == "" {
+		rule.SourceType = storage.PeerTypeChannel
+	}
+	if err := ValidateRule(rule); err != nil {
+		return nil, err
+	}
+	return compileRule(rule)
+}
+
+// TestText matches sample text against the candidate rule and all enabled
+// rules, whatever their source. Sender filters see an unknown sender.
+func (e *Engine) TestText(candidate storage.ForwardRule, text string) (TestResult, error) {
+	// Sample text is in no forum topic
+	candidate.SourceTopicIDs = nil
+	cr, err := compileCandidate(candidate)
+	if err != nil {
+		return TestResult{}, err
+	}
+
+	msgs := []*tg.Message{{Message: text}}
+	res := TestResult{Scanned: 1}
+	res.add(e.testMessages(cr, nil, msgs, sender{}))
+	return res, nil
+}
+
+// TestSource runs the candidate rule and the enabled rules of the same source
+// over the latest posts of the candidate's source. Nothing is delivered.
+func (e *Engine) TestSource(ctx context.Context, candidate storage.ForwardRule, limit int) (TestResult, error) {
+	if limit <= 0 {
+		limit = DefaultTestLimit
+	}
+	if limit > MaxTestLimit {
+		return TestResult{}, fmt.Errorf("limit must not exceed %d", MaxTestLimit)
+	}
+	cr, err := compileCandidate(candidate)
+	if err != nil {
+		return TestResult{}, err
+	}
+	if e.apiGetter == nil {
+		return TestResult{}, fmt.Errorf("API getter not set")
+	}
+
+	history, err := e.apiGetter().MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{
+		Peer:  sourcePeer(candidate),
+		Limit: limit,
+	})
+	if err != nil {
+		return TestResult{}, fmt.Errorf("get history: %w", err)
+	}
+	modified, ok := history.AsModified()
+	if !ok {
+		return TestResult{}, fmt.Errorf("unexpected history response %T", history)
+	}
+	ents := newEntities(modified.GetUsers(), modified.GetChats())
+	source := peerRef{typ: candidate.SourceType, id: candidate.SourceChannelID}
+	if isChannel(source.typ) {
+		source.typ = storage.PeerTypeChannel
+	}
+
+	units := groupAlbums(modified.GetMessages())
+	slices.Reverse(units)
+	var res TestResult
+	for _, msgs := range units {
+		res.Scanned++
+		res.add(e.testMessages(cr, &source, msgs, ents.senderOf(msgs[0])))
+	}
+	return res, nil
+}
+
+// testMessages matches a post against the candidate and the enabled rules,
+// only those of the source if one is given.
+func (e *Engine) testMessages(cr *compiledRule, source *peerRef, msgs []*tg.Message, snd sender) TestMessage {
+	text := groupText(msgs)
+	tm := TestMessage{
+		MessageID:  msgs[0].ID,
+		Text:       text,
+		SenderName: snd.name,
+		Matched:    cr.match(msgs, snd),
+		Rules:      []uint{},
+	}
+	if msgs[0].Date != 0 {
+		d := time.Unix(int64(msgs[0].Date), 0)
+		tm.Date = &d
+	}
+	if tm.Matched {
+		tm.Groups = cr.groups(text)
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, rule := range e.rules {
+		if source != nil && !source.isSourceOf(rule) {
+			continue
+		}
+		if c, ok := e.compiled[rule.ID]; ok && c.match(msgs, snd) {
+			tm.Rules = append(tm.Rules, rule.ID)
+		}
+	}
+	return tm
+}
+
+func (r *TestResult) add(tm TestMessage) {
+	if tm.Matched {
+		r.Matched++
+	}
+	r.Messages = append(r.Messages, tm)
+}
@@ -0,0 +1,145 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/rs/zerolog/log"
+	"github.com/tg-manager/internal/storage"
+	"gorm.io/gorm"
+)
+
+// errNoCopy means an edit cannot be applied because the target message of
+// the delivered copy is unknown.
+var errNoCopy = errors.New("target message of the copy is unknown")
+
+func (e *Engine) handleEditedMessage(m tg.MessageClass, ents entities) {
+	msg, ok := m.(*tg.Message)
+	if !ok {
+		return
+	}
+
+	source, ok := peerOf(msg.PeerID)
+	if !ok {
+		return
+	}
+
+	e.handleEdit(source, msg, ents.senderOf(msg))
+}
+
+// handleEdit processes an edited source message. Delivered copies get the
+// edit applied in place; forward-mode rules with ForwardEdits forward the
+// edited version again, also to webhooks. An edit that makes a message match for the first
+// time is forwarded like a new message.
+func (e *Engine) handleEdit(source peerRef, msg *tg.Message, snd sender) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var items []storage.OutboxItem
+	for _, rule := range e.rules {
+		// Digests summarise posts as they were first seen
+		if !source.isSourceOf(rule) || rule.DeliveryMode == storage.DeliveryModeDigest {
+			continue
+		}
+
+		cr, ok := e.compiled[rule.ID]
+		if !ok {
+			continue
+		}
+		matched := cr.match([]*tg.Message{msg}, snd)
+		at, admitted := cr.admit(time.Now())
+
+		for _, target := range rule.Targets {
+			delivered := e.deliveredOrQueued(rule.ID, target.ID, msg.ID)
+
+			action, editDate := storage.OutboxActionSend, msg.EditDate
+			switch {
+			case delivered && rule.DeliveryMode == storage.DeliveryModeCopy && target.TargetType != storage.PeerTypeWebhook:
+				action = storage.OutboxActionEdit
+			case delivered && rule.ForwardEdits && matched && admitted:
+			case !delivered && matched && admitted && msg.GroupedID == 0:
+				// Newly matching; album parts are only matched as a whole
+				editDate = 0
+			default:
+				continue
+			}
+
+			item, err := newOutboxItem(rule.ID, target.ID, []*tg.Message{msg}, snd)
+			if err != nil {
+				log.Error().Err(err).Uint("rule_id", rule.ID).Msg("Failed to queue edit")
+				continue
+			}
+			item.Action, item.EditDate = action, editDate
+			if action == storage.OutboxActionSend {
+				item.NextAttemptAt = at
+			}
+			items = append(items, item)
+		}
+	}
+
+	if err := e.enqueue(items); err != nil {
+		log.Error().Err(err).Int64("source", source.id).Int("message_id", msg.ID).
+			Msg("Failed to queue edit")
+	}
+}
+
+// deliveredOrQueued reports whether the message was delivered to the target
+// or is still waiting in the outbox. Edits queued behind a pending delivery
+// are applied after it.
+func (e *Engine) deliveredOrQueued(ruleID, targetID uint, msgID int) bool {
+	var count int64
+	e.db.Model(&storage.ForwardLog{}).
+		Where("rule_id = ? AND target_id = ? AND message_id = ? AND status = ?",
+			ruleID, targetID, msgID, storage.ForwardStatusSent).
+		Count(&count)
+	if count > 0 {
+		return true
+	}
+
+	e.db.Model(&storage.OutboxItem{}).
+		Where("rule_id = ? AND target_id = ? AND message_ids @> ?::jsonb AND action = ? AND status IN ?",
+			ruleID, targetID, fmt.Sprintf("[%d]", msgID), storage.OutboxActionSend,
+			[]string{storage.OutboxPending, storage.OutboxSending}).
+		Count(&count)
+	return count > 0
+}
+
+// edit applies the text of an edited source message, transformed like the
+// original copy, to the copy in the target.
+func (e *Engine) edit(ctx context.Context, msg *tg.Message, rule storage.ForwardRule, target storage.ForwardTarget, cr *compiledRule) error {
+	if e.apiGetter == nil {
+		return fmt.Errorf("API getter not set, cannot edit")
+	}
+
+	var mapping storage.MessageMapping
+	err := e.db.Where("rule_id = ? AND target_id = ? AND source_message_id = ?", rule.ID, target.ID, msg.ID).
+		First(&mapping).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errNoCopy
+	}
+	if err != nil {
+		return err
+	}
+
+	out, err := cr.transform(msg)
+	if err != nil {
+		return err
+	}
+
+	_, hasPreview := out.Media.(*tg.MessageMediaWebPage)
+	_, err = e.apiGetter().MessagesEditMessage(ctx, &tg.MessagesEditMessageRequest{
+		Peer:      targetPeer(target),
+		ID:        mapping.TargetMessageID,
+		Message:   out.Message,
+		Entities:  out.Entities,
+		NoWebpage: !hasPreview,
+	})
+	if tgerr.Is(err, "MESSAGE_NOT_MODIFIED") {
+		return nil
+	}
+	return err
+}
@@ -2,7 +2,9 @@ package forwarder
 
 import (
 	"context"
-	"regexp"
+	"fmt"
+	"net/http"
+	"slices"
 	"sync"
 	"time"
 
@@ -10,24 +12,47 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/tg-manager/internal/storage"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Engine struct {
 	ctx       context.Context // app-lifecycle context for cancellation
 	db        *gorm.DB
 	apiGetter func() *tg.Client
+	http      *http.Client // webhook targets
 
-	mu          sync.RWMutex
-	rules       []storage.ForwardRule
-	compiled    map[uint]*regexp.Regexp
-	lastForward map[uint]time.Time
+	mu       sync.RWMutex
+	rules    []storage.ForwardRule
+	compiled map[uint]*compiledRule
+
+	albumMu sync.Mutex
+	albums  map[albumKey]*albumBuffer
+
+	outboxMu sync.Mutex
+	busy     map[streamKey]bool
+	buckets  map[streamKey]*tokenBucket
+	wake     chan struct{}
+
+	jobsMu sync.Mutex
+	jobs   map[uint]context.CancelFunc // running backfill jobs
+
+	ownMu    sync.Mutex
+	inflight map[int64]bool       // random IDs of sends in progress
+	own      map[msgKey]time.Time // messages the engine sent, see Sent
 }
 
 func NewEngine(db *gorm.DB) *Engine {
 	return &Engine{
-		db:          db,
-		compiled:    make(map[uint]*regexp.Regexp),
-		lastForward: make(map[uint]time.Time),
+		db:       db,
+		http:     &http.Client{},
+		compiled: make(map[uint]*compiledRule),
+		albums:   make(map[albumKey]*albumBuffer),
+		busy:     make(map[streamKey]bool),
+		buckets:  make(map[streamKey]*tokenBucket),
+		wake:     make(chan struct{}, 1),
+		jobs:     make(map[uint]context.CancelFunc),
+		inflight: make(map[int64]bool),
+		own:      make(map[msgKey]time.Time),
 	}
 }
 
@@ -42,27 +67,26 @@ func (e *Engine) SetAPIGetter(getter func() *tg.Client) {
 	e.apiGetter = getter
 }
 
-// ReloadRules loads all enabled rules from DB and compiles regex patterns.
+// ReloadRules loads all enabled rules from DB and compiles their patterns and templates.
 func (e *Engine) ReloadRules() error {
 	var rules []storage.ForwardRule
-	if err := e.db.Where("enabled = ?", true).Find(&rules).Error; err != nil {
+	if err := e.db.Preload("Targets").Where("enabled = ?", true).Find(&rules).Error; err != nil {
 		return err
 	}
 
-	compiled := make(map[uint]*regexp.Regexp)
+	compiled := make(map[uint]*compiledRule)
 	for _, r := range rules {
-		re, err := regexp.Compile(r.MatchPattern)
+		c, err := compileRule(r)
 		if err != nil {
-			log.Warn().Uint("rule_id", r.ID).Err(err).Msg("Failed to compile rule pattern, skipping")
+			log.Warn().Uint("rule_id", r.ID).Err(err).Msg("Failed to compile rule, skipping")
 			continue
 		}
-		compiled[r.ID] = re
+		compiled[r.ID] = c
 	}
 
 	e.mu.Lock()
 	e.rules = rules
 	e.compiled = compiled
-	e.lastForward = make(map[uint]time.Time)
 	e.mu.Unlock()
 
 	log.Info().Int("count", len(rules)).Msg("Forwarding rules loaded")
@@ -73,240 +97,301 @@ func (e *Engine) ReloadRules() error {
 func (e *Engine) Handle(ctx context.Context, updates tg.UpdatesClass) error {
 	switch u := updates.(type) {
 	case *tg.Updates:
+		ents := newEntities(u.Users, u.Chats)
 		for _, update := range u.Updates {
-			if newMsg, ok := update.(*tg.UpdateNewChannelMessage); ok {
-				e.handleChannelMessage(ctx, newMsg)
-			}
+			e.handleUpdate(update, ents)
 		}
 	case *tg.UpdateShort:
-		if newMsg, ok := u.Update.(*tg.UpdateNewChannelMessage); ok {
-			e.handleChannelMessage(ctx, newMsg)
-		}
+		e.handleUpdate(u.Update, newEntities(nil, nil))
 	}
 	return nil
 }
 
-func (e *Engine) handleChannelMessage(ctx context.Context, update *tg.UpdateNewChannelMessage) {
-	msg, ok := update.Message.(*tg.Message)
-	if !ok || msg.Message == "" {
+// handleUpdate dispatches an update. Messages the engine sent itself, and
+// their edits and deletes, are not handled as source messages.
+func (e *Engine) handleUpdate(update tg.UpdateClass, ents entities) {
+	switch u := update.(type) {
+	case *tg.UpdateNewChannelMessage:
+		if !e.isOwn(u.Message) {
+			e.handleNewMessage(u.Message, ents)
+		}
+	case *tg.UpdateNewMessage:
+		if !e.isOwn(u.Message) {
+			e.handleNewMessage(u.Message, ents)
+		}
+	case *tg.UpdateEditChannelMessage:
+		if !e.isOwn(u.Message) {
+			e.handleEditedMessage(u.Message, ents)
+		}
+	case *tg.UpdateEditMessage:
+		if !e.isOwn(u.Message) {
+			e.handleEditedMessage(u.Message, ents)
+		}
+	case *tg.UpdateDeleteChannelMessages:
+		e.handleDelete(u.ChannelID, e.notOwn(u.ChannelID, u.Messages))
+	case *tg.UpdateDeleteMessages:
+		e.handleDelete(0, e.notOwn(0, u.Messages))
+	}
+}
+
+func (e *Engine) handleNewMessage(m tg.MessageClass, ents entities) {
+	msg, ok := m.(*tg.Message)
+	if !ok {
 		return
 	}
 
-	// Extract channel ID from PeerChannel
-	peer, ok := msg.PeerID.(*tg.PeerChannel)
+	source, ok := peerOf(msg.PeerID)
 	if !ok {
 		return
 	}
-	channelID := peer.ChannelID
 
+	// Album parts arrive as separate updates; collect them first.
+	snd := ents.senderOf(msg)
+	if msg.GroupedID != 0 {
+		e.bufferAlbum(source, msg, snd)
+		return
+	}
+
+	e.handleMessages(source, []*tg.Message{msg}, snd)
+}
+
+// handleMessages matches a single message or a complete album from the
+// given chat against the rules and queues it as one unit for every target of
+// the matching rules.
+func (e *Engine) handleMessages(source peerRef, msgs []*tg.Message, snd sender) {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
+	var (
+		items   []storage.OutboxItem
+		entries []storage.DigestEntry
+	)
 	for _, rule := range e.rules {
-		if rule.SourceChannelID != channelID {
+		if !source.isSourceOf(rule) {
 			continue
 		}
 
-		re, ok := e.compiled[rule.ID]
+		cr, ok := e.compiled[rule.ID]
 		if !ok {
 			continue
 		}
 
-		if !re.MatchString(msg.Message) {
+		if !cr.match(msgs, snd) {
 			continue
 		}
 
-		// Dedup: check if this message was already forwarded by this rule
-		var count int64
-		e.db.Model(&storage.ForwardLog{}).
-			Where("rule_id = ? AND message_id = ?", rule.ID, msg.ID).
-			Count(&count)
-		if count > 0 {
-			log.Debug().Uint("rule_id", rule.ID).Int("message_id", msg.ID).
-				Msg("Message already forwarded, skipping (dedup)")
+		at, ok := cr.admit(time.Now())
+		if !ok {
+			log.Debug().Uint("rule_id", rule.ID).Int("message_id", msgs[0].ID).
+				Msg("Match outside of the rule's schedule, dropping")
 			continue
 		}
 
-		// Rate limit: at most 1 forward per rule per minute
-		if last, ok := e.lastForward[rule.ID]; ok && time.Since(last) < time.Minute {
-			log.Info().Uint("rule_id", rule.ID).Int("message_id", msg.ID).
-				Msg("Rate limit hit, skipping forward")
+		if rule.DeliveryMode == storage.DeliveryModeDigest {
+			entries = append(entries, newDigestEntry(rule, msgs, snd))
 			continue
 		}
 
-		log.Info().
-			Int64("source", rule.SourceChannelID).
-			Int64("target", rule.TargetChannelID).
-			Uint("rule_id", rule.ID).
-			Str("match", rule.MatchPattern).
-			Msg("Forwarding message")
+		for _, target := range rule.Targets {
+			// Dedup: drop parts already delivered to this target
+			pending := e.notForwarded(rule.ID, target.ID, msgs)
+			if len(pending) == 0 {
+				log.Debug().Uint("rule_id", rule.ID).Uint("target_id", target.ID).Int("message_id", msgs[0].ID).
+					Msg("Message already forwarded, skipping (dedup)")
+				continue
+			}
+
+			item, err := newOutboxItem(rule.ID, target.ID, pending, snd)
+			if err != nil {
+				log.Error().Err(err).Uint("rule_id", rule.ID).Msg("Failed to queue message")
+				continue
+			}
+			item.NextAttemptAt = at
+			items = append(items, item)
+		}
+	}
 
-		go e.forwardMessage(ctx, msg, rule)
+	if err := e.enqueue(items); err != nil {
+		log.Error().Err(err).Int64("source", source.id).Int("message_id", msgs[0].ID).
+			Msg("Failed to queue message")
+	}
+	if err := e.collectDigest(entries); err != nil {
+		log.Error().Err(err).Int64("source", source.id).Int("message_id", msgs[0].ID).
+			Msg("Failed to collect message for digest")
 	}
 }
 
-// BackfillRule fetches the latest 50 messages from the rule's source channel,
-// matches them against the rule's pattern, and forwards matches with a 1-per-minute
-// rate limit. Runs entirely in the background.
-func (e *Engine) BackfillRule(rule storage.ForwardRule) {
-	logger := log.With().Uint("rule_id", rule.ID).Logger()
+// notForwarded returns the messages not yet delivered to the rule's target.
+func (e *Engine) notForwarded(ruleID, targetID uint, msgs []*tg.Message) []*tg.Message {
+	ids := make([]int, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
 
+	var done []int
+	e.db.Model(&storage.ForwardLog{}).
+		Where("rule_id = ? AND target_id = ? AND message_id IN ? AND status IN ?",
+			ruleID, targetID, ids, []string{storage.ForwardStatusSent, storage.ForwardStatusSkipped}).
+		Pluck("message_id", &done)
+
+	var pending []*tg.Message
+	for _, m := range msgs {
+		if !slices.Contains(done, m.ID) {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// send delivers a single message or all parts of an album to one target of
+// the rule in one request. It returns the target message ID of every
+// delivered source message.
+func (e *Engine) send(ctx context.Context, msgs []*tg.Message, randomIDs []int64, rule storage.ForwardRule, target storage.ForwardTarget, cr *compiledRule) (map[int]int, error) {
 	if e.apiGetter == nil {
-		logger.Error().Msg("Backfill: API getter not set")
-		return
+		return nil, fmt.Errorf("API getter not set, cannot forward")
 	}
 
 	api := e.apiGetter()
+	defer e.sending(randomIDs)()
 
-	// 1. Fetch latest 50 messages from source channel
-	sourcePeer := &tg.InputPeerChannel{
-		ChannelID:  rule.SourceChannelID,
-		AccessHash: rule.SourceHash,
-	}
+	fromPeer := sourcePeer(rule)
+	toPeer := targetPeer(target)
 
-	history, err := api.MessagesGetHistory(e.ctx, &tg.MessagesGetHistoryRequest{
-		Peer:  sourcePeer,
-		Limit: 50,
-	})
-	if err != nil {
-		logger.Error().Err(err).Msg("Backfill: failed to fetch message history")
-		return
+	ids := make([]int, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
 	}
 
-	// Extract messages from the response
-	var msgs []tg.MessageClass
-	switch h := history.(type) {
-	case *tg.MessagesMessages:
-		msgs = h.Messages
-	case *tg.MessagesMessagesSlice:
-		msgs = h.Messages
-	case *tg.MessagesChannelMessages:
-		msgs = h.Messages
+	var (
+		updates tg.UpdatesClass
+		err     error
+	)
+	switch rule.DeliveryMode {
+	case storage.DeliveryModeCopy:
+		var out []*tg.Message
+		if out, err = cr.transformAlbum(msgs); err == nil {
+			at := placement{topic: target.TopicID, replyTo: e.targetReply(rule, target, msgs)}
+			updates, err = copyMessages(ctx, api, fromPeer, toPeer, at, out, randomIDs)
+		}
 	default:
-		logger.Warn().Msg("Backfill: unexpected history response type")
-		return
+		updates, err = api.MessagesForwardMessages(ctx, &tg.MessagesForwardMessagesRequest{
+			FromPeer: fromPeer,
+			ToPeer:   toPeer,
+			ID:       ids,
+			RandomID: randomIDs,
+			TopMsgID: placement{topic: target.TopicID}.topMsgID(),
+		})
 	}
-
-	// 2. Compile regex
-	re, err := regexp.Compile(rule.MatchPattern)
 	if err != nil {
-		logger.Error().Err(err).Msg("Backfill: failed to compile pattern")
-		return
+		return nil, err
 	}
+	return sentMessageIDs(updates, msgs, randomIDs), nil
+}
 
-	// 3. Collect matching messages (oldest-first for chronological forwarding)
-	var matched []*tg.Message
-	for i := len(msgs) - 1; i >= 0; i-- {
-		msg, ok := msgs[i].(*tg.Message)
-		if !ok || msg.Message == "" {
-			continue
-		}
-		if !re.MatchString(msg.Message) {
-			continue
+// targetReply returns the target message that a copy should reply to: the
+// copy of the source message the original replies to, if the rule delivered
+// it to the target.
+func (e *Engine) targetReply(rule storage.ForwardRule, target storage.ForwardTarget, msgs []*tg.Message) int {
+	var replyTo int
+	for _, m := range msgs {
+		if replyTo = replyOf(m); replyTo != 0 {
+			break
 		}
-
-		// 4. Dedup check
-		var count int64
-		e.db.Model(&storage.ForwardLog{}).
-			Where("rule_id = ? AND message_id = ?", rule.ID, msg.ID).
-			Count(&count)
-		if count > 0 {
-			logger.Debug().Int("message_id", msg.ID).Msg("Backfill: already forwarded, skipping")
-			continue
-		}
-
-		matched = append(matched, msg)
+	}
+	if replyTo == 0 {
+		return 0
 	}
 
-	if len(matched) == 0 {
-		logger.Info().Msg("Backfill: no new matching messages found")
-		return
+	var mapping storage.MessageMapping
+	err := e.db.Where("rule_id = ? AND target_id = ? AND source_message_id = ?", rule.ID, target.ID, replyTo).
+		First(&mapping).Error
+	if err != nil {
+		return 0
 	}
+	return mapping.TargetMessageID
+}
 
-	logger.Info().Int("count", len(matched)).Msg("Starting backfill")
+// sentMessageIDs maps source message IDs to the IDs of the messages they
+// produced in the target, matching the random IDs of the request.
+func sentMessageIDs(updates tg.UpdatesClass, msgs []*tg.Message, randomIDs []int64) map[int]int {
+	bySource := make(map[int64]int, len(msgs))
+	for i, m := range msgs {
+		bySource[randomIDs[i]] = m.ID
+	}
 
-	// 5. Channel-based rate-limited forwarding
-	ch := make(chan *tg.Message, len(matched))
-	for _, m := range matched {
-		ch <- m
+	sent := make(map[int]int, len(msgs))
+	var list []tg.UpdateClass
+	switch u := updates.(type) {
+	case *tg.Updates:
+		list = u.Updates
+	case *tg.UpdatesCombined:
+		list = u.Updates
+	case *tg.UpdateShortSentMessage:
+		sent[msgs[0].ID] = u.ID
 	}
-	close(ch)
-
-	go func() {
-		ticker := time.NewTicker(time.Minute)
-		defer ticker.Stop()
-
-		first := true
-		for msg := range ch {
-			if !first {
-				select {
-				case <-ticker.C:
-				case <-e.ctx.Done():
-					logger.Info().Msg("Backfill: cancelled by shutdown")
-					return
-				}
+	for _, update := range list {
+		if id, ok := update.(*tg.UpdateMessageID); ok {
+			if src, ok := bySource[id.RandomID]; ok {
+				sent[src] = id.ID
 			}
-			first = false
-
-			// Re-check dedup before forwarding (race with real-time forwarding)
-			var count int64
-			e.db.Model(&storage.ForwardLog{}).
-				Where("rule_id = ? AND message_id = ?", rule.ID, msg.ID).
-				Count(&count)
-			if count > 0 {
-				logger.Debug().Int("message_id", msg.ID).Msg("Backfill: already forwarded (race), skipping")
-				continue
-			}
-
-			logger.Info().Int("message_id", msg.ID).Msg("Backfill: forwarding message")
-			e.forwardMessage(e.ctx, msg, rule)
 		}
-
-		logger.Info().Msg("Backfill complete")
-	}()
+	}
+	return sent
 }
 
-func (e *Engine) forwardMessage(ctx context.Context, msg *tg.Message, rule storage.ForwardRule) {
-	if e.apiGetter == nil {
-		log.Error().Msg("API getter not set, cannot forward")
-		return
+// recordDelivery writes the forward log, one entry per album part, with the
+// delivery status for the target and the error, skip reason or note. A later
+// successful retry overwrites a failed entry.
+func recordDelivery(tx *gorm.DB, item storage.OutboxItem, rule storage.ForwardRule, target storage.ForwardTarget, msgs []*tg.Message, status, reason string) error {
+	logs := make([]storage.ForwardLog, 0, len(msgs))
+	for _, m := range msgs {
+		logs = append(logs, storage.ForwardLog{
+			RuleID:          rule.ID,
+			TargetID:        target.ID,
+			MessageID:       m.ID,
+			SourceChannelID: rule.SourceChannelID,
+			TargetChannelID: target.TargetChannelID,
+			SenderID:        item.SenderID,
+			SenderName:      item.SenderName,
+			Fingerprint:     item.Fingerprint,
+			Status:          status,
+			Error:           reason,
+		})
 	}
 
-	api := e.apiGetter()
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "rule_id"}, {Name: "target_id"}, {Name: "message_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "error", "created_at"}),
+	}).Create(&logs).Error
+	if err != nil {
+		return fmt.Errorf("record forward log: %w", err)
+	}
+	return nil
+}
 
-	fromPeer := &tg.InputPeerChannel{
-		ChannelID:  rule.SourceChannelID,
-		AccessHash: rule.SourceHash,
+// recordMappings stores the target message IDs of delivered source messages.
+// A repeated delivery (a forwarded edit) replaces the earlier mapping.
+func recordMappings(tx *gorm.DB, rule storage.ForwardRule, target storage.ForwardTarget, sent map[int]int) error {
+	if len(sent) == 0 {
+		return nil
 	}
-	toPeer := &tg.InputPeerChannel{
-		ChannelID:  rule.TargetChannelID,
-		AccessHash: rule.TargetHash,
+
+	mappings := make([]storage.MessageMapping, 0, len(sent))
+	for src, dst := range sent {
+		mappings = append(mappings, storage.MessageMapping{
+			RuleID:          rule.ID,
+			TargetID:        target.ID,
+			SourceMessageID: src,
+			TargetMessageID: dst,
+		})
 	}
 
-	_, err := api.MessagesForwardMessages(ctx, &tg.MessagesForwardMessagesRequest{
-		FromPeer: fromPeer,
-		ToPeer:   toPeer,
-		ID:       []int{msg.ID},
-		RandomID: []int64{int64(msg.ID) * 1000},
-	})
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "rule_id"}, {Name: "target_id"}, {Name: "source_message_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"target_message_id", "created_at"}),
+	}).Create(&mappings).Error
 	if err != nil {
-		log.Error().Err(err).
-			Int64("source", rule.SourceChannelID).
-			Int64("target", rule.TargetChannelID).
-			Msg("Failed to forward message")
-		return
+		return fmt.Errorf("record message mapping: %w", err)
 	}
-
-	// Record forward log for dedup
-	e.db.Create(&storage.ForwardLog{
-		RuleID:          rule.ID,
-		MessageID:       msg.ID,
-		SourceChannelID: rule.SourceChannelID,
-		TargetChannelID: rule.TargetChannelID,
-	})
-
-	// Update rate limit timestamp
-	e.mu.Lock()
-	e.lastForward[rule.ID] = time.Now()
-	e.mu.Unlock()
+	return nil
 }
@@ -0,0 +1,87 @@
+package forwarder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+	"gorm.io/gorm"
+)
+
+// fingerprint hashes the content of a message or album: its text with case
+// and whitespace normalised, and the IDs of its photos and documents. Reposts
+// of the same content in different chats share the fingerprint. Messages
+// without text or files have none.
+func fingerprint(msgs []*tg.Message) string {
+	text := strings.Join(strings.Fields(strings.ToLower(groupText(msgs))), " ")
+
+	var files []string
+	for _, m := range msgs {
+		switch media := m.Media.(type) {
+		case *tg.MessageMediaPhoto:
+			if photo, ok := media.Photo.(*tg.Photo); ok {
+				files = append(files, fmt.Sprintf("photo:%d", photo.ID))
+			}
+		case *tg.MessageMediaDocument:
+			if doc, ok := media.Document.(*tg.Document); ok {
+				files = append(files, fmt.Sprintf("doc:%d", doc.ID))
+			}
+		}
+	}
+	if text == "" && len(files) == 0 {
+		return ""
+	}
+	slices.Sort(files)
+
+	h := sha256.New()
+	h.Write([]byte(text))
+	for _, f := range files {
+		h.Write([]byte{0})
+		h.Write([]byte(f))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// duplicateContent returns why the item's content is a duplicate for the
+// target, or "" if it is not.
+func (e *Engine) duplicateContent(item storage.OutboxItem, target storage.ForwardTarget) string {
+	if target.DedupHours <= 0 || item.Fingerprint == "" {
+		return ""
+	}
+
+	q := e.deliveredTo(target).Where("fingerprint = ? AND created_at > ?",
+		item.Fingerprint, time.Now().Add(-time.Duration(target.DedupHours)*time.Hour))
+
+	var prev storage.ForwardLog
+	err := q.Order("id desc").First(&prev).Error
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("duplicate of message %d from chat %d (rule %d), sent %s",
+		prev.MessageID, prev.SourceChannelID, prev.RuleID, prev.CreatedAt.Format(time.DateTime))
+}
+
+// deliveredTo queries the forward log for messages sent to the target's
+// destination by any rule. Chat targets are the same destination when their
+// chat IDs and types match; supergroups are channels.
+func (e *Engine) deliveredTo(target storage.ForwardTarget) *gorm.DB {
+	q := e.db.Model(&storage.ForwardLog{}).Where("status = ?", storage.ForwardStatusSent)
+	if target.TargetType == storage.PeerTypeWebhook {
+		// Webhooks have no chat ID; they are the same destination by URL
+		return q.Where("target_id IN (?)", e.db.Model(&storage.ForwardTarget{}).Select("id").
+			Where("target_type = ? AND webhook_url = ?", storage.PeerTypeWebhook, target.WebhookURL))
+	}
+	// Users, basic groups and channels have separate ID spaces. Logs of
+	// deleted targets are kept, whatever their type was.
+	kinds := []string{target.TargetType}
+	if isChannel(target.TargetType) {
+		kinds = []string{storage.PeerTypeChannel, storage.PeerTypeSupergroup}
+	}
+	others := e.db.Model(&storage.ForwardTarget{}).Select("id").Where("target_type NOT IN ?", kinds)
+	return q.Where("target_channel_id = ? AND target_id NOT IN (?)", target.TargetChannelID, others)
+}
@@ -0,0 +1,63 @@
+package forwarder
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tg-manager/internal/storage"
+)
+
+func TestDeliveredToMatchesTargetType(t *testing.T) {
+	db := testDB(t)
+	e := NewEngine(db)
+
+	// A user, a basic group and a channel may share an ID
+	chatID := time.Now().UnixNano()
+	rule := storage.ForwardRule{
+		SourceType:      storage.PeerTypeChannel,
+		SourceChannelID: chatID + 1,
+		DeliveryMode:    storage.DeliveryModeForward,
+		Targets: []storage.ForwardTarget{
+			{TargetType: storage.PeerTypeUser, TargetChannelID: chatID},
+			{TargetType: storage.PeerTypeChannel, TargetChannelID: chatID},
+		},
+	}
+	if err := db.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.ForwardLog{})
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.ForwardTarget{})
+		db.Delete(&rule)
+	})
+	for i, target := range rule.Targets {
+		log := storage.ForwardLog{
+			RuleID: rule.ID, TargetID: target.ID, MessageID: i + 1,
+			SourceChannelID: rule.SourceChannelID, TargetChannelID: chatID, Status: storage.ForwardStatusSent,
+		}
+		if err := db.Create(&log).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		targetType string
+		want       []int
+	}{
+		{storage.PeerTypeUser, []int{1}},
+		{storage.PeerTypeChannel, []int{2}},
+		{storage.PeerTypeSupergroup, []int{2}},
+		{storage.PeerTypeGroup, nil},
+	}
+	for _, tt := range tests {
+		var got []int
+		target := storage.ForwardTarget{TargetType: tt.targetType, TargetChannelID: chatID}
+		if err := e.deliveredTo(target).Order("message_id").Pluck("message_id", &got).Error; err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s %d: delivered messages %v, want %v", tt.targetType, chatID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package forwarder
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+// mediaInfo describes the media attached to a message.
+type mediaInfo struct {
+	kind     string
+	mimeType string
+	fileName string
+	size     int64
+	hasFile  bool
+}
+
+func describeMedia(msg *tg.Message) mediaInfo {
+	switch m := msg.Media.(type) {
+	case nil, *tg.MessageMediaEmpty, *tg.MessageMediaWebPage:
+		return mediaInfo{kind: storage.MediaText}
+	case *tg.MessageMediaPhoto:
+		info := mediaInfo{kind: storage.MediaPhoto, mimeType: "image/jpeg", hasFile: true}
+		if photo, ok := m.Photo.(*tg.Photo); ok {
+			info.size = photoSize(photo)
+		}
+		return info
+	case *tg.MessageMediaDocument:
+		doc, ok := m.Document.(*tg.Document)
+		if !ok {
+			return mediaInfo{kind: storage.MediaDocument}
+		}
+		info := mediaInfo{
+			kind:     storage.MediaDocument,
+			mimeType: doc.MimeType,
+			size:     doc.Size,
+			hasFile:  true,
+		}
+		for _, attr := range doc.Attributes {
+			switch a := attr.(type) {
+			case *tg.DocumentAttributeFilename:
+				info.fileName = a.FileName
+			case *tg.DocumentAttributeVideo:
+				if info.kind == storage.MediaDocument {
+					info.kind = storage.MediaVideo
+				}
+			case *tg.DocumentAttributeAudio:
+				if a.Voice {
+					info.kind = storage.MediaVoice
+				} else {
+					info.kind = storage.MediaAudio
+				}
+			case *tg.DocumentAttributeAnimated:
+				info.kind = storage.MediaAnimation
+			case *tg.DocumentAttributeSticker:
+				info.kind = storage.MediaSticker
+			}
+		}
+		return info
+	default:
+		return mediaInfo{kind: storage.MediaOther}
+	}
+}
+
+// photoSize returns the byte size of the largest photo variant.
+func photoSize(photo *tg.Photo) int64 {
+	var size int
+	for _, s := range photo.Sizes {
+		switch ps := s.(type) {
+		case *tg.PhotoSize:
+			size = max(size, ps.Size)
+		case *tg.PhotoSizeProgressive:
+			if n := len(ps.Sizes); n > 0 {
+				size = max(size, ps.Sizes[n-1])
+			}
+		}
+	}
+	return int64(size)
+}
+
+// matchMedia applies the rule's media filters to msg.
+func (c *compiledRule) matchMedia(msg *tg.Message) bool {
+	rule := c.rule
+	info := describeMedia(msg)
+
+	if len(rule.MediaTypes) > 0 && !slices.Contains(rule.MediaTypes, info.kind) {
+		return false
+	}
+
+	fileFilters := len(rule.MimeTypes) > 0 || c.fileName != nil || rule.MinSize > 0 || rule.MaxSize > 0
+	if !fileFilters {
+		return true
+	}
+	if !info.hasFile {
+		return false
+	}
+	if len(rule.MimeTypes) > 0 && !matchMimeType(rule.MimeTypes, info.mimeType) {
+		return false
+	}
+	if c.fileName != nil && !c.fileName.MatchString(info.fileName) {
+		return false
+	}
+	if rule.MinSize > 0 && info.size < rule.MinSize {
+		return false
+	}
+	if rule.MaxSize > 0 && info.size > rule.MaxSize {
+		return false
+	}
+	return true
+}
+
+// matchMimeType matches mimeType against patterns like "image/*" or "application/pdf".
+func matchMimeType(patterns []string, mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if prefix, ok := strings.CutSuffix(p, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if p == mimeType {
+			return true
+		}
+	}
+	return false
+}
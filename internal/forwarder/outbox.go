@@ -0,0 +1,601 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/rs/zerolog/log"
+	"github.com/tg-manager/internal/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	outboxPollInterval = time.Second
+	outboxBatchSize    = 500
+	outboxMaxAttempts  = 10
+	outboxMaxBackoff   = 10 * time.Minute
+)
+
+// streamKey identifies the delivery stream from a rule to one of its targets.
+// Each stream delivers in source message order, one item at a time, and has
+// its own token bucket.
+type streamKey struct {
+	ruleID   uint
+	targetID uint
+}
+
+func newOutboxItem(ruleID, targetID uint, msgs []*tg.Message, snd sender) (storage.OutboxItem, error) {
+	payload, err := encodeMessages(msgs)
+	if err != nil {
+		return storage.OutboxItem{}, err
+	}
+	ids := make([]int, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	return storage.OutboxItem{
+		RuleID:        ruleID,
+		TargetID:      targetID,
+		MessageID:     ids[0],
+		MessageIDs:    ids,
+		RandomIDs:     newRandomIDs(len(ids)),
+		SenderID:      snd.id,
+		SenderName:    snd.name,
+		Fingerprint:   fingerprint(msgs),
+		Action:        storage.OutboxActionSend,
+		Payload:       payload,
+		Status:        storage.OutboxPending,
+		NextAttemptAt: time.Now(),
+	}, nil
+}
+
+// newRandomIDs returns n random IDs for sending messages. Telegram ignores a
+// send with a random ID it has already seen from the account, so the IDs
+// must not repeat across rules, targets and sources.
+func newRandomIDs(n int) []int64 {
+	ids := make([]int64, n)
+	var buf [8]byte
+	for i := range ids {
+		for ids[i] == 0 {
+			rand.Read(buf[:])
+			ids[i] = int64(binary.LittleEndian.Uint64(buf[:]))
+		}
+	}
+	return ids
+}
+
+// ensureRandomIDs gives an item that was queued without random IDs its IDs
+// and stores them before the first attempt.
+func (e *Engine) ensureRandomIDs(item *storage.OutboxItem) error {
+	n := len(item.MessageIDs)
+	if item.Action == storage.OutboxActionDigest {
+		n = 1
+	}
+	if len(item.RandomIDs) == n {
+		return nil
+	}
+	item.RandomIDs = newRandomIDs(n)
+	return e.db.Model(item).Select("random_ids").Updates(storage.OutboxItem{RandomIDs: item.RandomIDs}).Error
+}
+
+// randomIDsOf returns the random IDs of the item's messages among msgs.
+func randomIDsOf(item storage.OutboxItem, msgs []*tg.Message) []int64 {
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, item.RandomIDs[slices.Index(item.MessageIDs, m.ID)])
+	}
+	return ids
+}
+
+func encodeMessages(msgs []*tg.Message) ([]byte, error) {
+	var buf bin.Buffer
+	for _, m := range msgs {
+		if err := m.Encode(&buf); err != nil {
+			return nil, fmt.Errorf("encode message %d: %w", m.ID, err)
+		}
+	}
+	return buf.Raw(), nil
+}
+
+func decodeMessages(payload []byte) ([]*tg.Message, error) {
+	buf := bin.Buffer{Buf: payload}
+	var msgs []*tg.Message
+	for buf.Len() > 0 {
+		m, err := tg.DecodeMessage(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("decode message: %w", err)
+		}
+		if msg, ok := m.(*tg.Message); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// requeue is the conflict clause of outbox inserts. A delivery that is
+// already queued, being sent or done is left alone; one that was cancelled
+// or failed is queued again as if new. It keeps its random IDs unless its
+// messages changed: a failed attempt may have reached Telegram, which then
+// drops the repeat as RANDOM_ID_DUPLICATE.
+var requeue = clause.OnConflict{
+	Columns: []clause.Column{{Name: "rule_id"}, {Name: "target_id"}, {Name: "message_id"}, {Name: "action"}, {Name: "edit_date"}},
+	DoUpdates: append(clause.AssignmentColumns([]string{
+		"message_ids", "sender_id", "sender_name", "fingerprint", "job_id", "payload",
+		"status", "attempts", "next_attempt_at", "last_error", "updated_at",
+	}), clause.Assignment{
+		Column: clause.Column{Name: "random_ids"},
+		Value: clause.Expr{SQL: `CASE WHEN outbox_items.message_ids = excluded.message_ids
+			THEN COALESCE(outbox_items.random_ids, excluded.random_ids) ELSE excluded.random_ids END`},
+	}),
+	Where: clause.Where{Exprs: []clause.Expression{
+		clause.Expr{SQL: "outbox_items.status IN (?, ?)", Vars: []interface{}{storage.OutboxCancelled, storage.OutboxFailed}},
+	}},
+}
+
+// enqueue stores deliveries in the outbox. All items are inserted in one
+// statement; deliveries that are already queued are ignored, cancelled and
+// failed ones are queued again.
+func (e *Engine) enqueue(items []storage.OutboxItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if err := e.db.Clauses(requeue).Create(&items).Error; err != nil {
+		return fmt.Errorf("enqueue deliveries: %w", err)
+	}
+	e.wakeOutbox()
+	return nil
+}
+
+func (e *Engine) wakeOutbox() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start launches the outbox worker and the digest scheduler. Deliveries
+// interrupted by a crash or restart are put back into the queue first; their
+// stored random IDs keep sends that went through from being repeated.
+func (e *Engine) Start() {
+	err := e.db.Model(&storage.OutboxItem{}).
+		Where("status = ?", storage.OutboxSending).
+		Update("status", storage.OutboxPending).Error
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to requeue interrupted deliveries")
+	}
+
+	go e.runOutbox()
+	go e.runDigests()
+}
+
+func (e *Engine) runOutbox() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		e.processOutbox()
+		select {
+		case <-ticker.C:
+		case <-e.wake:
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// processOutbox starts delivery of the head item of every stream that is
+// due, idle and within its rate limit. Items of disabled rules stay queued.
+func (e *Engine) processOutbox() {
+	// Backfills queue history newest page first, so the head of a stream
+	// is its oldest source message rather than its oldest item
+	var items []storage.OutboxItem
+	err := e.db.
+		Select("DISTINCT ON (rule_id, target_id) *").
+		Where("status = ? AND rule_id IN (?)", storage.OutboxPending,
+			e.db.Model(&storage.ForwardRule{}).Select("id").Where("enabled = ?", true)).
+		Order("rule_id, target_id, message_id, id").Limit(outboxBatchSize).
+		Find(&items).Error
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load outbox")
+		return
+	}
+
+	now := time.Now()
+	for _, item := range items {
+		key := streamKey{ruleID: item.RuleID, targetID: item.TargetID}
+		if item.NextAttemptAt.After(now) {
+			continue
+		}
+		rule, target, cr, ok := e.lookupTarget(item.RuleID, item.TargetID)
+		if !ok {
+			continue
+		}
+		if item.Action == storage.OutboxActionSend && !cr.schedule.active(now) {
+			// Queued matches wait for the next window, also for rules
+			// that drop matches found outside of it
+			if next := cr.schedule.nextOpen(now); !next.IsZero() {
+				e.db.Model(&item).Update("next_attempt_at", next)
+			}
+			continue
+		}
+		// Only posts count against the rate limit
+		needToken := item.Action == storage.OutboxActionSend || item.Action == storage.OutboxActionDigest
+		if !e.acquireStream(key, effectiveRateLimit(rule, target), needToken, now) {
+			continue
+		}
+
+		if err := e.db.Model(&item).Update("status", storage.OutboxSending).Error; err != nil {
+			log.Error().Err(err).Uint("outbox_id", item.ID).Msg("Failed to claim outbox item")
+			e.releaseStream(key)
+			continue
+		}
+		go e.deliver(key, item, rule, target, cr)
+	}
+}
+
+// lookupTarget finds a loaded rule and one of its targets.
+func (e *Engine) lookupTarget(ruleID, targetID uint) (storage.ForwardRule, storage.ForwardTarget, *compiledRule, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	cr, ok := e.compiled[ruleID]
+	if !ok {
+		return storage.ForwardRule{}, storage.ForwardTarget{}, nil, false
+	}
+	for _, t := range cr.rule.Targets {
+		if t.ID == targetID {
+			return cr.rule, t, cr, true
+		}
+	}
+	return storage.ForwardRule{}, storage.ForwardTarget{}, nil, false
+}
+
+// acquireStream marks the stream busy if it is idle and, when needToken is
+// set, its token bucket has a token. The token is only taken by takeToken
+// once the item turns out not to be a duplicate.
+func (e *Engine) acquireStream(key streamKey, cfg rateLimit, needToken bool, now time.Time) bool {
+	e.outboxMu.Lock()
+	defer e.outboxMu.Unlock()
+
+	if e.busy[key] {
+		return false
+	}
+	if !needToken {
+		e.busy[key] = true
+		return true
+	}
+	b, ok := e.buckets[key]
+	if !ok {
+		b = newTokenBucket(cfg, now)
+		e.buckets[key] = b
+	} else {
+		b.setLimit(cfg)
+	}
+	if wait := b.wait(now); wait > 0 {
+		log.Debug().Uint("rule_id", key.ruleID).Uint("target_id", key.targetID).Dur("wait", wait).
+			Msg("Rate limit reached, delivery stays queued")
+		return false
+	}
+	e.busy[key] = true
+	return true
+}
+
+// takeToken takes the token acquireStream found for a busy stream.
+func (e *Engine) takeToken(key streamKey) {
+	e.outboxMu.Lock()
+	defer e.outboxMu.Unlock()
+	if b, ok := e.buckets[key]; ok {
+		b.take(time.Now())
+	}
+}
+
+func (e *Engine) releaseStream(key streamKey) {
+	e.outboxMu.Lock()
+	delete(e.busy, key)
+	e.outboxMu.Unlock()
+	e.wakeOutbox()
+}
+
+// deliver sends one outbox item and records the outcome.
+func (e *Engine) deliver(key streamKey, item storage.OutboxItem, rule storage.ForwardRule, target storage.ForwardTarget, cr *compiledRule) {
+	defer e.releaseStream(key)
+
+	logger := log.With().Uint("outbox_id", item.ID).Uint("rule_id", rule.ID).
+		Uint("target_id", target.ID).Int("message_id", item.MessageID).Logger()
+
+	if item.Action == storage.OutboxActionSend || item.Action == storage.OutboxActionDigest {
+		if err := e.ensureRandomIDs(&item); err != nil {
+			e.retryOutbox(item, rule, target, nil, fmt.Errorf("store random IDs: %w", err))
+			return
+		}
+	}
+	if item.Action == storage.OutboxActionDigest {
+		e.takeToken(key)
+		e.deliverDigest(logger, item, rule, target)
+		return
+	}
+
+	msgs, err := decodeMessages(item.Payload)
+	if err != nil {
+		e.failOutbox(item, rule, target, nil, err)
+		return
+	}
+
+	var (
+		sent map[int]int
+		note string
+	)
+	switch {
+	case item.Action == storage.OutboxActionDelete:
+		logger.Info().Int64("target", target.TargetChannelID).Ints("message_ids", item.MessageIDs).
+			Msg("Deleting delivered messages")
+		err = e.deleteCopies(e.ctx, item.MessageIDs, rule, target)
+	case item.Action == storage.OutboxActionEdit:
+		logger.Info().Int64("target", target.TargetChannelID).Int("attempt", item.Attempts+1).
+			Msg("Applying edit to copy")
+		err = e.edit(e.ctx, msgs[0], rule, target, cr)
+		if errors.Is(err, errNoCopy) {
+			e.failOutbox(item, rule, target, nil, err)
+			return
+		}
+	default:
+		// Dedup: parts may have been delivered by an earlier item. A
+		// forwarded edit is a deliberate repeat.
+		if item.EditDate == 0 {
+			msgs = e.notForwarded(rule.ID, target.ID, msgs)
+			if len(msgs) == 0 {
+				e.db.Model(&item).Update("status", storage.OutboxDone)
+				return
+			}
+			if reason := e.duplicateContent(item, target); reason != "" {
+				logger.Info().Str("reason", reason).Msg("Skipping duplicate content")
+				e.skipOutbox(item, rule, target, msgs, reason)
+				return
+			}
+		}
+		e.takeToken(key)
+
+		if target.TargetType == storage.PeerTypeWebhook {
+			logger.Info().Str("url", target.WebhookURL).Int("parts", len(msgs)).
+				Int("attempt", item.Attempts+1).Msg("Posting message to webhook")
+			err = e.postMessages(e.ctx, item, msgs, rule, target, cr)
+			break
+		}
+		logger.Info().Int64("target", target.TargetChannelID).Str("mode", rule.DeliveryMode).
+			Int("parts", len(msgs)).Int("attempt", item.Attempts+1).Msg("Forwarding message")
+		sent, err = e.send(e.ctx, msgs, randomIDsOf(item, msgs), rule, target, cr)
+		if tgerr.Is(err, "RANDOM_ID_DUPLICATE") {
+			// An earlier attempt went through but was not recorded. The
+			// target messages are unknown, so edits, deletes and replies
+			// cannot reach them.
+			logger.Error().Msg("Message was already delivered by an earlier attempt, target messages unknown")
+			err, note = nil, noteUnmapped
+		}
+	}
+	if err == nil {
+		if err = e.completeOutbox(item, rule, target, msgs, sent, note); err != nil {
+			// Telegram drops the repeated send by its random IDs
+			e.retryOutbox(item, rule, target, nil, err)
+		}
+		return
+	}
+
+	if tgerr.Is(err, "FILE_REFERENCE_EXPIRED", "FILE_REFERENCE_INVALID") {
+		// Copies reference the source media; stale references are renewed
+		// by fetching the messages again.
+		if payload, rerr := e.refetchPayload(rule, msgs); rerr == nil {
+			item.Payload = payload
+		} else {
+			logger.Warn().Err(rerr).Msg("Failed to refresh file references")
+		}
+	}
+	if item.Action != storage.OutboxActionSend {
+		// A failed edit or delete leaves the log entry of the delivery alone
+		msgs = nil
+	}
+	e.retryOutbox(item, rule, target, msgs, err)
+}
+
+// noteUnmapped is the forward log note of a send whose target messages are
+// unknown.
+const noteUnmapped = "delivered by an earlier attempt; target messages unknown"
+
+// completeOutbox marks the item done and writes the forward log, with the
+// note if any, and message mappings of a send atomically.
+func (e *Engine) completeOutbox(item storage.OutboxItem, rule storage.ForwardRule, target storage.ForwardTarget, msgs []*tg.Message, sent map[int]int, note string) error {
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if item.Action == storage.OutboxActionSend {
+			if err := recordDelivery(tx, item, rule, target, msgs, storage.ForwardStatusSent, note); err != nil {
+				return err
+			}
+			if err := recordMappings(tx, rule, target, sent); err != nil {
+				return err
+			}
+			if item.JobID != 0 {
+				err := tx.Model(&storage.BackfillJob{}).Where("id = ?", item.JobID).
+					Update("forwarded", gorm.Expr("forwarded + 1")).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Model(&item).Updates(map[string]interface{}{
+			"status":     storage.OutboxDone,
+			"last_error": "",
+		}).Error
+	})
+	if err != nil {
+		log.Error().Err(err).Uint("outbox_id", item.ID).Msg("Failed to record delivery")
+		return fmt.Errorf("record delivery: %w", err)
+	}
+	return nil
+}
+
+// skipOutbox marks the item done without sending and logs the reason.
+func (e *Engine) skipOutbox(item storage.OutboxItem, rule storage.ForwardRule, target storage.ForwardTarget, msgs []*tg.Message, reason string) {
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if err := recordDelivery(tx, item, rule, target, msgs, storage.ForwardStatusSkipped, reason); err != nil {
+			return err
+		}
+		return tx.Model(&item).Updates(map[string]interface{}{
+			"status":     storage.OutboxDone,
+			"last_error": reason,
+		}).Error
+	})
+	if err != nil {
+		log.Error().Err(err).Uint("outbox_id", item.ID).Msg("Failed to record skipped delivery")
+	}
+}
+
+// retryOutbox schedules another attempt for transient errors, honoring
+// FLOOD_WAIT, or fails the item permanently. Waits the server requires do
+// not count as attempts.
+func (e *Engine) retryOutbox(item storage.OutboxItem, rule storage.ForwardRule, target storage.ForwardTarget, msgs []*tg.Message, sendErr error) {
+	attempts := item.Attempts + 1
+	delay, retry := retryDelay(sendErr, attempts)
+	switch {
+	case errors.Is(sendErr, context.Canceled):
+		// Shutdown: the attempt did not really happen
+		attempts, delay, retry = item.Attempts, 0, true
+	case serverWait(sendErr):
+		// Waiting as told is no failed attempt
+		attempts = item.Attempts
+	}
+	if !retry || attempts >= outboxMaxAttempts {
+		item.Attempts = attempts
+		e.failOutbox(item, rule, target, msgs, sendErr)
+		return
+	}
+
+	log.Warn().Err(sendErr).Uint("outbox_id", item.ID).Uint("rule_id", rule.ID).
+		Int("attempts", attempts).Dur("retry_in", delay).Msg("Forward failed, will retry")
+
+	err := e.db.Model(&item).Updates(map[string]interface{}{
+		"status":          storage.OutboxPending,
+		"attempts":        attempts,
+		"next_attempt_at": time.Now().Add(delay),
+		"last_error":      sendErr.Error(),
+		"payload":         item.Payload,
+	}).Error
+	if err != nil {
+		log.Error().Err(err).Uint("outbox_id", item.ID).Msg("Failed to reschedule delivery")
+	}
+}
+
+// failOutbox records a permanent delivery failure.
+func (e *Engine) failOutbox(item storage.OutboxItem, rule storage.ForwardRule, target storage.ForwardTarget, msgs []*tg.Message, sendErr error) {
+	log.Error().Err(sendErr).
+		Uint("outbox_id", item.ID).
+		Int64("source", rule.SourceChannelID).
+		Int64("target", target.TargetChannelID).
+		Msg("Failed to forward message")
+
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		if len(msgs) > 0 {
+			if err := recordDelivery(tx, item, rule, target, msgs, storage.ForwardStatusFailed, sendErr.Error()); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&item).Updates(map[string]interface{}{
+			"status":     storage.OutboxFailed,
+			"attempts":   item.Attempts,
+			"last_error": sendErr.Error(),
+		}).Error
+	})
+	if err != nil {
+		log.Error().Err(err).Uint("outbox_id", item.ID).Msg("Failed to record delivery failure")
+	}
+}
+
+// retryDelay classifies a send error. FLOOD_WAIT and slow mode waits use the
+// server-provided duration; server errors, auth problems and network errors
+// back off exponentially; other RPC errors (bad peer, no rights, ...) are
+// permanent. Webhook responses are classified by status code.
+func retryDelay(err error, attempts int) (time.Duration, bool) {
+	var werr *webhookError
+	if errors.As(err, &werr) {
+		return werr.retryDelay(attempts)
+	}
+	if d, ok := tgerr.AsFloodWait(err); ok {
+		return d + time.Second, true
+	}
+	if rpcErr, ok := tgerr.As(err); ok {
+		switch {
+		case rpcErr.Code == 420:
+			return time.Duration(rpcErr.Argument+1) * time.Second, true
+		case rpcErr.Code == 401 || rpcErr.Code >= 500:
+			return backoff(attempts), true
+		case rpcErr.IsOneOf("FILE_REFERENCE_EXPIRED", "FILE_REFERENCE_INVALID"):
+			return 0, true
+		default:
+			return 0, false
+		}
+	}
+	return backoff(attempts), true
+}
+
+// serverWait reports whether the error is a wait the server requires:
+// FLOOD_WAIT, slow mode or a webhook's Retry-After.
+func serverWait(err error) bool {
+	var werr *webhookError
+	if errors.As(err, &werr) {
+		return werr.status == http.StatusTooManyRequests && werr.retryAfter > 0
+	}
+	if _, ok := tgerr.AsFloodWait(err); ok {
+		return true
+	}
+	rpcErr, ok := tgerr.As(err)
+	return ok && rpcErr.Code == 420
+}
+
+func backoff(attempts int) time.Duration {
+	d := time.Second << min(attempts, 10)
+	return min(d, outboxMaxBackoff)
+}
+
+// refetchPayload loads fresh copies of the source messages.
+func (e *Engine) refetchPayload(rule storage.ForwardRule, msgs []*tg.Message) ([]byte, error) {
+	ids := make([]tg.InputMessageClass, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, &tg.InputMessageID{ID: m.ID})
+	}
+	var (
+		resp tg.MessagesMessagesClass
+		err  error
+	)
+	if isChannel(rule.SourceType) {
+		resp, err = e.apiGetter().ChannelsGetMessages(e.ctx, &tg.ChannelsGetMessagesRequest{
+			Channel: &tg.InputChannel{ChannelID: rule.SourceChannelID, AccessHash: rule.SourceHash},
+			ID:      ids,
+		})
+	} else {
+		resp, err = e.apiGetter().MessagesGetMessages(e.ctx, ids)
+	}
+	if err != nil {
+		return nil, err
+	}
+	modified, ok := resp.AsModified()
+	if !ok {
+		return nil, fmt.Errorf("unexpected response %T", resp)
+	}
+	var fresh []*tg.Message
+	for _, m := range modified.GetMessages() {
+		if msg, ok := m.(*tg.Message); ok {
+			fresh = append(fresh, msg)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil, fmt.Errorf("source messages no longer exist")
+	}
+	return encodeMessages(fresh)
+}
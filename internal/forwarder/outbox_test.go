@@ -0,0 +1,99 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/tg-manager/internal/storage"
+)
+
+// invokerFunc answers the engine's API calls in tests.
+type invokerFunc func(ctx context.Context, input bin.Encoder, output bin.Decoder) error
+
+func (f invokerFunc) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	return f(ctx, input, output)
+}
+
+func TestDeliverRandomIDDuplicate(t *testing.T) {
+	db := testDB(t)
+	e := NewEngine(db)
+	e.SetContext(context.Background())
+	api := tg.NewClient(invokerFunc(func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+		return tgerr.New(400, "RANDOM_ID_DUPLICATE")
+	}))
+	e.SetAPIGetter(func() *tg.Client { return api })
+
+	rule := storage.ForwardRule{
+		SourceType:      storage.PeerTypeChannel,
+		SourceChannelID: time.Now().UnixNano(),
+		DeliveryMode:    storage.DeliveryModeForward,
+		Targets:         []storage.ForwardTarget{{TargetType: storage.PeerTypeSelf}},
+	}
+	if err := db.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.OutboxItem{})
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.ForwardLog{})
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.MessageMapping{})
+		db.Where("rule_id = ?", rule.ID).Delete(&storage.ForwardTarget{})
+		db.Delete(&rule)
+	})
+	target := rule.Targets[0]
+	cr, err := compileRule(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := newOutboxItem(rule.ID, target.ID, []*tg.Message{{ID: 5, Message: "hi"}}, sender{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&item).Error; err != nil {
+		t.Fatal(err)
+	}
+	e.deliver(streamKey{rule.ID, target.ID}, item, rule, target, cr)
+
+	if db.First(&item, item.ID); item.Status != storage.OutboxDone {
+		t.Errorf("outbox status %q, want %q", item.Status, storage.OutboxDone)
+	}
+	var entry storage.ForwardLog
+	if err := db.Where("rule_id = ? AND message_id = ?", rule.ID, 5).First(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != storage.ForwardStatusSent || entry.Error != noteUnmapped {
+		t.Errorf("forward log %q (%q), want %q (%q)", entry.Status, entry.Error, storage.ForwardStatusSent, noteUnmapped)
+	}
+	var mappings int64
+	db.Model(&storage.MessageMapping{}).Where("rule_id = ?", rule.ID).Count(&mappings)
+	if mappings != 0 {
+		t.Errorf("%d message mappings, want none", mappings)
+	}
+}
+
+func TestServerWait(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"flood wait", tgerr.New(420, "FLOOD_WAIT_30"), true},
+		{"slow mode", tgerr.New(420, "SLOWMODE_WAIT_10"), true},
+		{"webhook retry after", &webhookError{status: http.StatusTooManyRequests, retryAfter: time.Minute}, true},
+		{"webhook rate limit", &webhookError{status: http.StatusTooManyRequests}, false},
+		{"server error", tgerr.New(500, "INTERNAL"), false},
+		{"no rights", tgerr.New(403, "CHAT_WRITE_FORBIDDEN"), false},
+		{"network", errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		if got := serverWait(tt.err); got != tt.want {
+			t.Errorf("%s: serverWait = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package forwarder
+
+import (
+	"slices"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/rs/zerolog/log"
+	"github.com/tg-manager/internal/storage"
+)
+
+// ownMessagesTTL is how long the engine remembers the messages it sent.
+// Their updates arrive while the request is in flight or shortly after;
+// later edits and deletes find them through their message mappings.
+const ownMessagesTTL = 10 * time.Minute
+
+// msgKey identifies a message. Messages outside channels share one ID
+// sequence per account, so their channelID is 0.
+type msgKey struct {
+	channelID int64
+	id        int
+}
+
+func msgKeyOf(msg *tg.Message) msgKey {
+	if p, ok := msg.PeerID.(*tg.PeerChannel); ok {
+		return msgKey{channelID: p.ChannelID, id: msg.ID}
+	}
+	return msgKey{id: msg.ID}
+}
+
+// sending marks the random IDs of a request the engine is about to make;
+// the returned func unmarks them once it is done.
+func (e *Engine) sending(randomIDs []int64) (done func()) {
+	e.ownMu.Lock()
+	for _, id := range randomIDs {
+		e.inflight[id] = true
+	}
+	e.ownMu.Unlock()
+	return func() {
+		e.ownMu.Lock()
+		for _, id := range randomIDs {
+			delete(e.inflight, id)
+		}
+		e.ownMu.Unlock()
+	}
+}
+
+// Sent is given the updates returned by the client's own requests before
+// they are dispatched. The messages the engine's sends produced are
+// remembered, so that rules whose source is another rule's target do not
+// pick them up and loop.
+func (e *Engine) Sent(updates tg.UpdatesClass) {
+	var list []tg.UpdateClass
+	switch u := updates.(type) {
+	case *tg.Updates:
+		list = u.Updates
+	case *tg.UpdatesCombined:
+		list = u.Updates
+	}
+
+	e.ownMu.Lock()
+	defer e.ownMu.Unlock()
+	ids := make(map[int]bool)
+	for _, update := range list {
+		if u, ok := update.(*tg.UpdateMessageID); ok && e.inflight[u.RandomID] {
+			ids[u.ID] = true
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for key, at := range e.own {
+		if now.Sub(at) > ownMessagesTTL {
+			delete(e.own, key)
+		}
+	}
+	for _, update := range list {
+		var m tg.MessageClass
+		switch u := update.(type) {
+		case *tg.UpdateNewMessage:
+			m = u.Message
+		case *tg.UpdateNewChannelMessage:
+			m = u.Message
+		}
+		if msg, ok := m.(*tg.Message); ok && ids[msg.ID] {
+			e.own[msgKeyOf(msg)] = now
+		}
+	}
+}
+
+// isOwn reports whether the engine sent the message.
+func (e *Engine) isOwn(m tg.MessageClass) bool {
+	msg, ok := m.(*tg.Message)
+	if !ok {
+		return false
+	}
+	key := msgKeyOf(msg)
+	return len(e.notOwn(key.channelID, []int{key.id})) == 0
+}
+
+// notOwn returns the IDs of the messages in a channel, or outside channels
+// for channelID 0, that the engine did not send.
+func (e *Engine) notOwn(channelID int64, ids []int) []int {
+	rest := make([]int, 0, len(ids))
+	e.ownMu.Lock()
+	for _, id := range ids {
+		if _, ok := e.own[msgKey{channelID: channelID, id: id}]; !ok {
+			rest = append(rest, id)
+		}
+	}
+	e.ownMu.Unlock()
+	if len(rest) == 0 || !e.isTarget(channelID) {
+		return rest
+	}
+
+	// Copies sent before a restart or too long ago to be remembered
+	channels := []string{storage.PeerTypeChannel, storage.PeerTypeSupergroup}
+	query := e.db.Model(&storage.MessageMapping{}).
+		Joins("JOIN forward_targets ON forward_targets.id = message_mappings.target_id").
+		Where("message_mappings.target_message_id IN ?", rest)
+	if channelID != 0 {
+		query = query.Where("forward_targets.target_type IN ? AND forward_targets.target_channel_id = ?", channels, channelID)
+	} else {
+		query = query.Where("forward_targets.target_type NOT IN ?", append(channels, storage.PeerTypeWebhook))
+	}
+	var own []int
+	if err := query.Pluck("message_mappings.target_message_id", &own).Error; err != nil {
+		log.Error().Err(err).Int64("channel_id", channelID).Msg("Failed to look up delivered messages")
+		return rest
+	}
+	return slices.DeleteFunc(rest, func(id int) bool { return slices.Contains(own, id) })
+}
+
+// isTarget reports whether the channel, or any chat outside channels for
+// channelID 0, is a target of an enabled rule.
+func (e *Engine) isTarget(channelID int64) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, rule := range e.rules {
+		for _, t := range rule.Targets {
+			switch {
+			case t.TargetType == storage.PeerTypeWebhook:
+			case isChannel(t.TargetType):
+				if channelID != 0 && t.TargetChannelID == channelID {
+					return true
+				}
+			default:
+				if channelID == 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package forwarder
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+func TestSentMessagesAreOwn(t *testing.T) {
+	e := NewEngine(nil)
+	channelMsg := func(id int) *tg.Message {
+		return &tg.Message{ID: id, PeerID: &tg.PeerChannel{ChannelID: 100}}
+	}
+	sent := channelMsg(7)
+	other := channelMsg(8) // sent by someone else in the same request's updates
+	private := &tg.Message{ID: 7, PeerID: &tg.PeerUser{UserID: 100}}
+
+	done := e.sending([]int64{42})
+	e.Sent(&tg.Updates{Updates: []tg.UpdateClass{
+		&tg.UpdateMessageID{ID: 7, RandomID: 42},
+		&tg.UpdateNewChannelMessage{Message: sent},
+		&tg.UpdateNewChannelMessage{Message: other},
+	}})
+	done()
+
+	if !e.isOwn(sent) {
+		t.Error("sent message is not own")
+	}
+	if e.isOwn(other) {
+		t.Error("message of another sender is own")
+	}
+	if e.isOwn(private) {
+		t.Error("message with the same ID in another chat is own")
+	}
+	if got := e.notOwn(100, []int{6, 7, 8}); !slices.Equal(got, []int{6, 8}) {
+		t.Errorf("notOwn = %v, want [6 8]", got)
+	}
+
+	// Requests the engine did not make are not tracked
+	e.Sent(&tg.Updates{Updates: []tg.UpdateClass{
+		&tg.UpdateMessageID{ID: 9, RandomID: 42},
+		&tg.UpdateNewChannelMessage{Message: channelMsg(9)},
+	}})
+	if e.isOwn(channelMsg(9)) {
+		t.Error("message of a finished request is own")
+	}
+}
+
+func TestValidateRuleSourceTarget(t *testing.T) {
+	rule := func(targetType string, targetID int64, topics []int, topic int) storage.ForwardRule {
+		return storage.ForwardRule{
+			SourceType:      storage.PeerTypeSupergroup,
+			SourceChannelID: 100,
+			SourceTopicIDs:  topics,
+			DeliveryMode:    storage.DeliveryModeForward,
+			MatchPattern:    ".",
+			Targets:         []storage.ForwardTarget{{TargetType: targetType, TargetChannelID: targetID, TopicID: topic}},
+		}
+	}
+	tests := []struct {
+		name    string
+		rule    storage.ForwardRule
+		wantErr bool
+	}{
+		{"same chat", rule(storage.PeerTypeSupergroup, 100, nil, 0), true},
+		{"same chat as channel", rule(storage.PeerTypeChannel, 100, nil, 0), true},
+		{"read topic", rule(storage.PeerTypeSupergroup, 100, []int{3}, 3), true},
+		{"General topic", rule(storage.PeerTypeSupergroup, 100, []int{1}, 0), true},
+		{"other topic", rule(storage.PeerTypeSupergroup, 100, []int{3}, 4), false},
+		{"group with the same ID", rule(storage.PeerTypeGroup, 100, nil, 0), false},
+		{"other chat", rule(storage.PeerTypeSupergroup, 200, nil, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateRule(tt.rule); (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateRule() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
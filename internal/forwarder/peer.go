@@ -0,0 +1,77 @@
+package forwarder
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+// peerRef identifies a source chat by peer type (storage.PeerType*) and ID.
+type peerRef struct {
+	typ string
+	id  int64
+}
+
+func peerOf(peer tg.PeerClass) (peerRef, bool) {
+	switch p := peer.(type) {
+	case *tg.PeerChannel:
+		return peerRef{typ: storage.PeerTypeChannel, id: p.ChannelID}, true
+	case *tg.PeerChat:
+		return peerRef{typ: storage.PeerTypeGroup, id: p.ChatID}, true
+	case *tg.PeerUser:
+		return peerRef{typ: storage.PeerTypeUser, id: p.UserID}, true
+	}
+	return peerRef{}, false
+}
+
+// isSourceOf reports whether the chat is the rule's source.
+func (p peerRef) isSourceOf(rule storage.ForwardRule) bool {
+	typ := rule.SourceType
+	if isChannel(typ) {
+		typ = storage.PeerTypeChannel
+	}
+	return rule.SourceChannelID == p.id && typ == p.typ
+}
+
+// isSourceTarget reports whether the target is the rule's source chat. A
+// target posting into a forum topic the rule does not read is not.
+func isSourceTarget(rule storage.ForwardRule, t storage.ForwardTarget) bool {
+	typ := t.TargetType
+	if isChannel(typ) {
+		typ = storage.PeerTypeChannel
+	}
+	if !(peerRef{typ: typ, id: t.TargetChannelID}).isSourceOf(rule) {
+		return false
+	}
+	return len(rule.SourceTopicIDs) == 0 || slices.Contains(rule.SourceTopicIDs, cmp.Or(t.TopicID, generalTopicID))
+}
+
+// isChannel reports whether chats of the peer type are channels in the API
+// (supergroups are).
+func isChannel(peerType string) bool {
+	return peerType == storage.PeerTypeChannel || peerType == storage.PeerTypeSupergroup
+}
+
+// inputPeer builds the input peer of a chat of the given type.
+func inputPeer(peerType string, id, accessHash int64) tg.InputPeerClass {
+	switch peerType {
+	case storage.PeerTypeGroup:
+		return &tg.InputPeerChat{ChatID: id}
+	case storage.PeerTypeUser:
+		return &tg.InputPeerUser{UserID: id, AccessHash: accessHash}
+	case storage.PeerTypeSelf:
+		return &tg.InputPeerSelf{}
+	default:
+		return &tg.InputPeerChannel{ChannelID: id, AccessHash: accessHash}
+	}
+}
+
+func sourcePeer(rule storage.ForwardRule) tg.InputPeerClass {
+	return inputPeer(rule.SourceType, rule.SourceChannelID, rule.SourceHash)
+}
+
+func targetPeer(target storage.ForwardTarget) tg.InputPeerClass {
+	return inputPeer(target.TargetType, target.TargetChannelID, target.TargetHash)
+}
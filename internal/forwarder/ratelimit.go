@@ -0,0 +1,73 @@
+package forwarder
+
+import (
+	"time"
+
+	"github.com/tg-manager/internal/storage"
+)
+
+// rateLimit is a token-bucket configuration. A zero limit means unlimited.
+type rateLimit struct {
+	limit  int
+	period time.Duration
+	burst  int
+}
+
+// effectiveRateLimit returns the target's own limit if it has one, otherwise
+// the rule's.
+func effectiveRateLimit(rule storage.ForwardRule, target storage.ForwardTarget) rateLimit {
+	if target.RateLimit > 0 {
+		return rateLimit{limit: target.RateLimit, period: time.Duration(target.RatePeriod) * time.Second, burst: target.RateBurst}
+	}
+	return rateLimit{limit: rule.RateLimit, period: time.Duration(rule.RatePeriod) * time.Second, burst: rule.RateBurst}
+}
+
+// tokenBucket refills limit tokens per period, holding at most burst tokens.
+type tokenBucket struct {
+	cfg    rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(cfg rateLimit, now time.Time) *tokenBucket {
+	b := &tokenBucket{cfg: cfg, last: now}
+	b.tokens = b.capacity()
+	return b
+}
+
+func (b *tokenBucket) capacity() float64 {
+	return float64(max(b.cfg.burst, 1))
+}
+
+// setLimit changes the configuration, keeping the current fill level.
+func (b *tokenBucket) setLimit(cfg rateLimit) {
+	b.cfg = cfg
+	b.tokens = min(b.tokens, b.capacity())
+}
+
+// wait returns how long until a token is available, 0 if one is, without
+// taking it.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if b.cfg.limit <= 0 || b.cfg.period <= 0 {
+		return 0
+	}
+
+	perToken := b.cfg.period / time.Duration(b.cfg.limit)
+	b.tokens = min(b.capacity(), b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(perToken))
+}
+
+// take consumes a token if one is available and returns 0; otherwise it
+// returns how long to wait until the next token.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	wait := b.wait(now)
+	if wait == 0 && b.cfg.limit > 0 && b.cfg.period > 0 {
+		b.tokens--
+	}
+	return wait
+}
@@ -0,0 +1,79 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	type take struct {
+		at   time.Duration // since the bucket was created
+		wait time.Duration
+	}
+	tests := []struct {
+		name  string
+		cfg   rateLimit
+		takes []take
+	}{
+		{
+			name:  "unlimited",
+			cfg:   rateLimit{},
+			takes: []take{{0, 0}, {0, 0}, {0, 0}},
+		},
+		{
+			name:  "one per period without burst",
+			cfg:   rateLimit{limit: 1, period: time.Minute},
+			takes: []take{{0, 0}, {0, time.Minute}, {20 * time.Second, 40 * time.Second}, {time.Minute, 0}},
+		},
+		{
+			name:  "burst then wait",
+			cfg:   rateLimit{limit: 2, period: time.Minute, burst: 3},
+			takes: []take{{0, 0}, {0, 0}, {0, 0}, {0, 30 * time.Second}},
+		},
+		{
+			name:  "refill",
+			cfg:   rateLimit{limit: 2, period: time.Minute, burst: 2},
+			takes: []take{{0, 0}, {0, 0}, {30 * time.Second, 0}, {30 * time.Second, 30 * time.Second}, {time.Minute, 0}},
+		},
+		{
+			name: "refill is capped at burst",
+			cfg:  rateLimit{limit: 2, period: time.Minute, burst: 2},
+			takes: []take{
+				{0, 0}, {0, 0},
+				{time.Hour, 0}, {time.Hour, 0}, {time.Hour, 30 * time.Second},
+			},
+		},
+		{
+			name:  "refused takes cost nothing",
+			cfg:   rateLimit{limit: 1, period: time.Minute},
+			takes: []take{{0, 0}, {0, time.Minute}, {0, time.Minute}, {time.Minute, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			b := newTokenBucket(tt.cfg, start)
+			for i, tk := range tt.takes {
+				if got := b.take(start.Add(tk.at)); got != tk.wait {
+					t.Errorf("take #%d at %v: wait %v, want %v", i+1, tk.at, got, tk.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketWaitDoesNotTake(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newTokenBucket(rateLimit{limit: 1, period: time.Minute}, now)
+	for range 3 {
+		if got := b.wait(now); got != 0 {
+			t.Fatalf("wait %v, want 0", got)
+		}
+	}
+	if got := b.take(now); got != 0 {
+		t.Fatalf("take: wait %v, want 0", got)
+	}
+	if got := b.wait(now); got != time.Minute {
+		t.Fatalf("wait after take %v, want %v", got, time.Minute)
+	}
+}
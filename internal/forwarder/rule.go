@@ -0,0 +1,207 @@
+package forwarder
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"text/template"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+// compiledRule holds the pre-compiled regexes and templates of a rule.
+type compiledRule struct {
+	rule         storage.ForwardRule
+	pattern      *regexp.Regexp
+	conditions   compiledConditions
+	schedule     *compiledSchedule
+	digest       *compiledDigest // digest rules only
+	fileName     *regexp.Regexp
+	replacements []compiledReplacement
+	prefix       *template.Template
+	suffix       *template.Template
+}
+
+type compiledReplacement struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func compileRule(rule storage.ForwardRule) (*compiledRule, error) {
+	re, err := regexp.Compile(rule.MatchPattern)
+	if err != nil {
+		return nil, fmt.Errorf("match pattern: %w", err)
+	}
+	c := &compiledRule{rule: rule, pattern: re}
+
+	if c.conditions, err = compileConditions(rule.Conditions); err != nil {
+		return nil, err
+	}
+	if c.schedule, err = compileSchedule(rule.Schedule); err != nil {
+		return nil, err
+	}
+	if rule.DeliveryMode == storage.DeliveryModeDigest {
+		if c.digest, err = compileDigest(rule.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	if rule.FileNamePattern != "" {
+		if c.fileName, err = regexp.Compile(rule.FileNamePattern); err != nil {
+			return nil, fmt.Errorf("file name pattern: %w", err)
+		}
+	}
+
+	for i, r := range rule.Replacements {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("replacement #%d: %w", i+1, err)
+		}
+		c.replacements = append(c.replacements, compiledReplacement{re: re, replacement: r.Replacement})
+	}
+
+	if c.prefix, err = parseTemplate("prefix", rule.PrefixTemplate); err != nil {
+		return nil, err
+	}
+	if c.suffix, err = parseTemplate("suffix", rule.SuffixTemplate); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s template: %w", name, err)
+	}
+	return t, nil
+}
+
+var mediaKinds = []string{
+	storage.MediaText, storage.MediaPhoto, storage.MediaVideo, storage.MediaAnimation,
+	storage.MediaAudio, storage.MediaVoice, storage.MediaSticker, storage.MediaDocument,
+	storage.MediaOther,
+}
+
+// ValidateRule checks that the rule's patterns and templates compile and
+// that its options are consistent with its delivery mode.
+func ValidateRule(rule storage.ForwardRule) error {
+	switch rule.DeliveryMode {
+	case storage.DeliveryModeForward, storage.DeliveryModeCopy, storage.DeliveryModeDigest:
+	default:
+		return fmt.Errorf("unsupported delivery_mode: %s", rule.DeliveryMode)
+	}
+	switch rule.SourceType {
+	case storage.PeerTypeChannel, storage.PeerTypeSupergroup, storage.PeerTypeGroup, storage.PeerTypeUser:
+	default:
+		return fmt.Errorf("unsupported source_type: %s", rule.SourceType)
+	}
+	if len(rule.SourceTopicIDs) > 0 && rule.SourceType != storage.PeerTypeSupergroup {
+		return fmt.Errorf("source_topic_ids require a supergroup source")
+	}
+	for _, id := range rule.SourceTopicIDs {
+		if id <= 0 {
+			return fmt.Errorf("invalid source topic: %d", id)
+		}
+	}
+	if len(rule.Targets) == 0 {
+		return fmt.Errorf("at least one target is required")
+	}
+	if err := validateRateLimit(rule.RateLimit, rule.RatePeriod, rule.RateBurst); err != nil {
+		return err
+	}
+	for _, t := range rule.Targets {
+		switch t.TargetType {
+		case storage.PeerTypeChannel, storage.PeerTypeSupergroup, storage.PeerTypeGroup, storage.PeerTypeUser:
+			if t.TargetChannelID == 0 {
+				return fmt.Errorf("target_channel_id is required")
+			}
+		case storage.PeerTypeSelf:
+		case storage.PeerTypeWebhook:
+			if err := validateWebhookURL(t.WebhookURL); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported target_type: %s", t.TargetType)
+		}
+		if err := validateRateLimit(t.RateLimit, t.RatePeriod, t.RateBurst); err != nil {
+			return fmt.Errorf("target %d: %w", t.TargetChannelID, err)
+		}
+		if t.TopicID < 0 {
+			return fmt.Errorf("target %d: invalid topic_id: %d", t.TargetChannelID, t.TopicID)
+		}
+		if t.TopicID > 0 && t.TargetType != storage.PeerTypeSupergroup {
+			return fmt.Errorf("target %d: topic_id requires a supergroup target", t.TargetChannelID)
+		}
+		if t.DedupHours < 0 {
+			return fmt.Errorf("target %d: dedup_hours must not be negative", t.TargetChannelID)
+		}
+		if isSourceTarget(rule, t) {
+			return fmt.Errorf("target %d: target must differ from the source", t.TargetChannelID)
+		}
+	}
+	if rule.MatchPattern == "" && !hasConditions(rule.Conditions) {
+		return fmt.Errorf("match_pattern or conditions are required")
+	}
+	if _, err := compileRule(rule); err != nil {
+		return err
+	}
+	hasTransforms := len(rule.Replacements) > 0 || rule.PrefixTemplate != "" || rule.SuffixTemplate != ""
+	if hasTransforms && rule.DeliveryMode != storage.DeliveryModeCopy {
+		return fmt.Errorf("text transforms require delivery_mode %q", storage.DeliveryModeCopy)
+	}
+	for _, t := range rule.MediaTypes {
+		if !slices.Contains(mediaKinds, t) {
+			return fmt.Errorf("unknown media type: %s", t)
+		}
+	}
+	if rule.MinSize < 0 || rule.MaxSize < 0 || (rule.MaxSize > 0 && rule.MinSize > rule.MaxSize) {
+		return fmt.Errorf("invalid size range: %d-%d", rule.MinSize, rule.MaxSize)
+	}
+	return nil
+}
+
+// match reports whether a message or album by the sender satisfies the rule.
+// Forum sources can be limited to some of their topics.
+// For media posts the caption is the matched text; an album matches as a
+// whole when its captions match and at least one part passes the media
+// filters.
+func (c *compiledRule) match(msgs []*tg.Message, s sender) bool {
+	if !c.matchSender(s) || !slices.ContainsFunc(msgs, c.matchMedia) {
+		return false
+	}
+	if len(c.rule.SourceTopicIDs) > 0 && !slices.Contains(c.rule.SourceTopicIDs, topicOf(msgs[0])) {
+		return false
+	}
+	text := groupText(msgs)
+	return c.pattern.MatchString(text) && c.conditions.match(text)
+}
+
+// groups returns the named capture groups of the match pattern in text.
+func (c *compiledRule) groups(text string) map[string]string {
+	groups := make(map[string]string)
+	m := c.pattern.FindStringSubmatch(text)
+	if m == nil {
+		return groups
+	}
+	for i, name := range c.pattern.SubexpNames() {
+		if name != "" {
+			groups[name] = m[i]
+		}
+	}
+	return groups
+}
+
+func validateRateLimit(limit, period, burst int) error {
+	if limit < 0 || period < 0 || burst < 0 {
+		return fmt.Errorf("rate limit values must not be negative")
+	}
+	if limit > 0 && period == 0 {
+		return fmt.Errorf("rate_period is required when rate_limit is set")
+	}
+	return nil
+}
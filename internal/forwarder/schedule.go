@@ -0,0 +1,164 @@
+package forwarder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tg-manager/internal/storage"
+)
+
+// scheduleHorizon bounds the search for the next open window.
+const scheduleHorizon = 400 * 24 * time.Hour
+
+// compiledSchedule is a parsed storage.RuleSchedule.
+type compiledSchedule struct {
+	loc       *time.Location
+	windows   []scheduleWindow
+	blackouts map[string]bool
+	hold      bool
+}
+
+type scheduleWindow struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+}
+
+func compileSchedule(s storage.RuleSchedule) (*compiledSchedule, error) {
+	c := &compiledSchedule{loc: time.UTC, blackouts: make(map[string]bool)}
+
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("schedule timezone: %w", err)
+		}
+		c.loc = loc
+	}
+
+	switch s.Outside {
+	case "", storage.ScheduleDrop:
+	case storage.ScheduleHold:
+		c.hold = true
+	default:
+		return nil, fmt.Errorf("schedule outside: unsupported value %q", s.Outside)
+	}
+
+	for i, w := range s.Windows {
+		var cw scheduleWindow
+		var err error
+		if cw.start, err = parseClock(w.Start); err != nil {
+			return nil, fmt.Errorf("schedule window #%d start: %w", i+1, err)
+		}
+		if cw.end, err = parseClock(w.End); err != nil {
+			return nil, fmt.Errorf("schedule window #%d end: %w", i+1, err)
+		}
+		for _, d := range w.Days {
+			if d < 0 || d > 6 {
+				return nil, fmt.Errorf("schedule window #%d: invalid day %d", i+1, d)
+			}
+			cw.days[d] = true
+		}
+		if len(w.Days) == 0 {
+			cw.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		c.windows = append(c.windows, cw)
+	}
+
+	for _, d := range s.Blackouts {
+		if _, err := time.Parse(time.DateOnly, d); err != nil {
+			return nil, fmt.Errorf("schedule blackout %q: expected YYYY-MM-DD", d)
+		}
+		c.blackouts[d] = true
+	}
+	return c, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether the schedule is open at t.
+func (c *compiledSchedule) active(t time.Time) bool {
+	t = t.In(c.loc)
+	if c.blackouts[t.Format(time.DateOnly)] {
+		return false
+	}
+	if len(c.windows) == 0 {
+		return true
+	}
+
+	day := int(t.Weekday())
+	prev := (day + 6) % 7
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range c.windows {
+		switch {
+		case w.start == w.end:
+			if w.days[day] {
+				return true
+			}
+		case w.start < w.end:
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+		default:
+			// Runs past midnight: the evening belongs to the day it starts
+			if (w.days[day] && minute >= w.start) || (w.days[prev] && minute < w.end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nextOpen returns the first time at or after t when the schedule is open,
+// or the zero time if it never opens within scheduleHorizon.
+func (c *compiledSchedule) nextOpen(t time.Time) time.Time {
+	if c.active(t) {
+		return t
+	}
+
+	// Build times from the wall clock: days around DST changes are not 24h
+	year, month, date := t.In(c.loc).Date()
+	for d := 0; d*24 < int(scheduleHorizon.Hours()); d++ {
+		// Windows open at their start; blackouts end at midnight
+		candidates := []time.Time{time.Date(year, month, date+d, 0, 0, 0, 0, c.loc)}
+		for _, w := range c.windows {
+			candidates = append(candidates, time.Date(year, month, date+d, w.start/60, w.start%60, 0, 0, c.loc))
+		}
+		var best time.Time
+		for _, at := range candidates {
+			if at.After(t) && c.active(at) && (best.IsZero() || at.Before(best)) {
+				best = at
+			}
+		}
+		if !best.IsZero() {
+			return best
+		}
+	}
+	return time.Time{}
+}
+
+// admit decides when a match found at now may be delivered. ok is false if
+// the match is to be dropped.
+func (c *compiledRule) admit(now time.Time) (at time.Time, ok bool) {
+	if c.schedule.active(now) {
+		return now, true
+	}
+	if !c.schedule.hold {
+		return time.Time{}, false
+	}
+	at = c.schedule.nextOpen(now)
+	return at, !at.IsZero()
+}
+
+// ActiveNow reports whether the rule is enabled and inside its schedule.
+func ActiveNow(rule storage.ForwardRule, now time.Time) bool {
+	if !rule.Enabled {
+		return false
+	}
+	s, err := compileSchedule(rule.Schedule)
+	return err == nil && s.active(now)
+}
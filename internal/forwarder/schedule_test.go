@@ -0,0 +1,60 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tg-manager/internal/storage"
+)
+
+func TestNextOpenAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	tests := []struct {
+		name  string
+		start string
+		from  time.Time
+		want  time.Time
+	}{
+		{
+			name:  "spring forward",
+			start: "09:00",
+			from:  time.Date(2026, 3, 29, 0, 30, 0, 0, loc),
+			want:  time.Date(2026, 3, 29, 9, 0, 0, 0, loc),
+		},
+		{
+			name:  "fall back",
+			start: "09:00",
+			from:  time.Date(2026, 10, 25, 0, 30, 0, 0, loc),
+			want:  time.Date(2026, 10, 25, 9, 0, 0, 0, loc),
+		},
+		{
+			name:  "next day after fall back",
+			start: "09:00",
+			from:  time.Date(2026, 10, 25, 18, 0, 0, 0, loc),
+			want:  time.Date(2026, 10, 26, 9, 0, 0, 0, loc),
+		},
+		{
+			name:  "start in skipped hour",
+			start: "02:30",
+			from:  time.Date(2026, 3, 29, 0, 30, 0, 0, loc),
+			want:  time.Date(2026, 3, 29, 3, 30, 0, 0, loc),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := compileSchedule(storage.RuleSchedule{
+				Timezone: "Europe/Berlin",
+				Windows:  []storage.ScheduleWindow{{Start: tt.start, End: "17:00"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.nextOpen(tt.from); !got.Equal(tt.want) {
+				t.Fatalf("nextOpen = %v, want %v", got.In(loc), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package forwarder
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/gotd/td/tg"
+)
+
+// sender describes the author of a message as far as the update tells.
+type sender struct {
+	id       int64
+	username string
+	name     string
+	author   string // post_author signature
+	bot      bool
+}
+
+// entities indexes the users and chats that come with updates or history
+// pages, to resolve message senders.
+type entities struct {
+	users    map[int64]*tg.User
+	chats    map[int64]*tg.Chat
+	channels map[int64]*tg.Channel
+}
+
+func newEntities(users []tg.UserClass, chats []tg.ChatClass) entities {
+	ents := entities{
+		users:    make(map[int64]*tg.User),
+		chats:    make(map[int64]*tg.Chat),
+		channels: make(map[int64]*tg.Channel),
+	}
+	for _, u := range users {
+		if user, ok := u.(*tg.User); ok {
+			ents.users[user.ID] = user
+		}
+	}
+	for _, c := range chats {
+		switch chat := c.(type) {
+		case *tg.Chat:
+			ents.chats[chat.ID] = chat
+		case *tg.Channel:
+			ents.channels[chat.ID] = chat
+		}
+	}
+	return ents
+}
+
+// senderOf resolves the sender of msg. Posts without FromID are sent by the
+// channel itself, or by the other side of a private chat.
+func (ents entities) senderOf(msg *tg.Message) sender {
+	from := msg.FromID
+	if from == nil {
+		from = msg.PeerID
+	}
+
+	s := sender{author: msg.PostAuthor}
+	switch p := from.(type) {
+	case *tg.PeerUser:
+		s.id = p.UserID
+		if u, ok := ents.users[p.UserID]; ok {
+			s.username = u.Username
+			s.name = strings.TrimSpace(u.FirstName + " " + u.LastName)
+			s.bot = u.Bot
+		}
+	case *tg.PeerChannel:
+		s.id = p.ChannelID
+		if c, ok := ents.channels[p.ChannelID]; ok {
+			s.username = c.Username
+			s.name = c.Title
+		}
+	case *tg.PeerChat:
+		s.id = p.ChatID
+		if c, ok := ents.chats[p.ChatID]; ok {
+			s.name = c.Title
+		}
+	}
+	if s.author != "" {
+		s.name = s.author
+	}
+	return s
+}
+
+// matchSender applies the rule's sender filter.
+func (c *compiledRule) matchSender(s sender) bool {
+	f := c.rule.Senders
+	if f.DenyBots && s.bot {
+		return false
+	}
+	if matchSenderList(s, f.DenyIDs, f.DenyUsernames, f.DenyAuthors) {
+		return false
+	}
+	if len(f.AllowIDs) == 0 && len(f.AllowUsernames) == 0 && len(f.AllowAuthors) == 0 {
+		return true
+	}
+	return matchSenderList(s, f.AllowIDs, f.AllowUsernames, f.AllowAuthors)
+}
+
+func matchSenderList(s sender, ids []int64, usernames, authors []string) bool {
+	if s.id != 0 && slices.Contains(ids, s.id) {
+		return true
+	}
+	if s.username != "" && slices.ContainsFunc(usernames, func(u string) bool {
+		return strings.EqualFold(strings.TrimPrefix(u, "@"), s.username)
+	}) {
+		return true
+	}
+	return s.author != "" && slices.Contains(authors, s.author)
+}
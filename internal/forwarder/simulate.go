@@ -0,0 +1,384 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+const (
+	// DefaultSimulateDays is the history a simulation covers by default.
+	DefaultSimulateDays = 7
+	// MaxSimulateDays caps the history a simulation covers.
+	MaxSimulateDays = 30
+
+	simulateMaxMessages = 5000
+	simulateSamples     = 20
+)
+
+// Simulation outcomes of a match. Deliveries are per target.
+const (
+	OutcomeDelivered       = "delivered"
+	OutcomeRateLimited     = "rate_limited"     // delivered late because of the rate limit
+	OutcomeHeld            = "held"             // delivered when the schedule opens
+	OutcomeDuplicate       = "duplicate"        // delivered before, or skipped by the target's dedup window
+	OutcomeOutsideSchedule = "outside_schedule" // dropped
+)
+
+// SimulationResult reports what a rule would have done with the recent
+// history of its source.
+type SimulationResult struct {
+	Since     time.Time `json:"since"`
+	Scanned   int       `json:"scanned"`
+	Truncated bool      `json:"truncated"` // more history than a simulation scans
+	// Totals and counts per day, in the rule's timezone
+	Total SimulationDay   `json:"total"`
+	Days  []SimulationDay `json:"days"`
+	// The latest matches and rate-limited deliveries
+	Matches     []SimulationSample `json:"matches"`
+	RateLimited []SimulationSample `json:"rate_limited"`
+}
+
+// SimulationDay counts posts of the source by the day they were posted.
+// Deliveries and their outcomes count once per target; digest posts count
+// as deliveries on the day they are posted.
+type SimulationDay struct {
+	Date            string `json:"date,omitempty"`
+	Scanned         int    `json:"scanned"`
+	Matched         int    `json:"matched"`
+	OutsideSchedule int    `json:"outside_schedule"`
+	Delivered       int    `json:"delivered"`
+	RateLimited     int    `json:"rate_limited"`
+	Held            int    `json:"held"`
+	Duplicates      int    `json:"duplicates"`
+}
+
+// SimulationSample is the outcome of a match, for one target if delivered.
+type SimulationSample struct {
+	MessageID int       `json:"message_id"`
+	Date      time.Time `json:"date"`
+	Text      string    `json:"text"`
+	Target    string    `json:"target,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Delay     int       `json:"delay"` // seconds until delivery
+}
+
+// simTarget is the simulated delivery stream to one target.
+type simTarget struct {
+	target    storage.ForwardTarget
+	bucket    *tokenBucket
+	free      time.Time              // stream busy until
+	forwarded map[int]bool           // messages the rule delivered for real
+	seen      map[string][]time.Time // deliveries by content fingerprint, oldest first
+}
+
+// simulation replays history through a rule in posting order.
+type simulation struct {
+	cr      *compiledRule
+	res     *SimulationResult
+	days    map[string]*SimulationDay
+	targets []*simTarget
+
+	digestCount int
+	digestSince time.Time // oldest collected digest entry
+}
+
+// Simulate replays up to days of the source's history through the rule the
+// way live messages are handled: matching, schedule, dedup windows, rate
+// limits and digests. Nothing is delivered. Messages an existing rule
+// delivered before, and content any rule delivered to a target within its
+// dedup window, count as duplicates like they would live.
+func (e *Engine) Simulate(ctx context.Context, rule storage.ForwardRule, days int) (SimulationResult, error) {
+	if days <= 0 {
+		days = DefaultSimulateDays
+	}
+	if days > MaxSimulateDays {
+		return SimulationResult{}, fmt.Errorf("days must not exceed %d", MaxSimulateDays)
+	}
+	cr, err := compileRule(rule)
+	if err != nil {
+		return SimulationResult{}, err
+	}
+	if e.apiGetter == nil {
+		return SimulationResult{}, fmt.Errorf("API getter not set")
+	}
+
+	now := time.Now()
+	res := SimulationResult{Since: now.AddDate(0, 0, -days)}
+	history, ents, truncated, err := e.recentHistory(ctx, rule, res.Since)
+	if err != nil {
+		return SimulationResult{}, err
+	}
+	res.Truncated = truncated
+
+	s := &simulation{cr: cr, res: &res, days: make(map[string]*SimulationDay)}
+	for _, target := range rule.Targets {
+		t, err := e.newSimTarget(rule.ID, target, history, res.Since)
+		if err != nil {
+			return SimulationResult{}, err
+		}
+		s.targets = append(s.targets, t)
+	}
+	for _, msgs := range groupAlbums(history) {
+		s.post(msgs, ents.senderOf(msgs[0]))
+	}
+	s.flushDigest(now)
+
+	for d := res.Since.In(cr.schedule.loc); !d.After(now); d = d.AddDate(0, 0, 1) {
+		if day, ok := s.days[d.Format(time.DateOnly)]; ok {
+			res.Days = append(res.Days, *day)
+		} else {
+			res.Days = append(res.Days, SimulationDay{Date: d.Format(time.DateOnly)})
+		}
+	}
+	return res, nil
+}
+
+// recentHistory fetches the source's messages posted since the given time,
+// newest first.
+func (e *Engine) recentHistory(ctx context.Context, rule storage.ForwardRule, since time.Time) ([]tg.MessageClass, entities, bool, error) {
+	var (
+		history  []tg.MessageClass
+		users    []tg.UserClass
+		chats    []tg.ChatClass
+		attempts int
+	)
+	req := &tg.MessagesGetHistoryRequest{Peer: sourcePeer(rule), Limit: backfillPageSize}
+	for {
+		resp, err := e.apiGetter().MessagesGetHistory(ctx, req)
+		if err != nil {
+			attempts++
+			delay, retry := retryDelay(err, attempts)
+			if !retry || attempts >= backfillMaxAttempts || sleep(ctx, delay) != nil {
+				return nil, entities{}, false, fmt.Errorf("get history: %w", err)
+			}
+			continue
+		}
+		attempts = 0
+
+		modified, ok := resp.AsModified()
+		if !ok {
+			return nil, entities{}, false, fmt.Errorf("unexpected history response %T", resp)
+		}
+		page := modified.GetMessages()
+		users = append(users, modified.GetUsers()...)
+		chats = append(chats, modified.GetChats()...)
+		for _, m := range page {
+			if d := messageDate(m); !d.IsZero() && d.Before(since) {
+				return history, newEntities(users, chats), false, nil
+			}
+			history = append(history, m)
+			if len(history) >= simulateMaxMessages {
+				return history, newEntities(users, chats), true, nil
+			}
+		}
+		if len(page) < req.Limit {
+			return history, newEntities(users, chats), false, nil
+		}
+		req.OffsetID = page[len(page)-1].GetID()
+	}
+}
+
+func (s *simulation) day(t time.Time) *SimulationDay {
+	key := t.In(s.cr.schedule.loc).Format(time.DateOnly)
+	d, ok := s.days[key]
+	if !ok {
+		d = &SimulationDay{Date: key}
+		s.days[key] = d
+	}
+	return d
+}
+
+// count applies fn to the counts of the day and the totals.
+func (s *simulation) count(t time.Time, fn func(d *SimulationDay)) {
+	fn(s.day(t))
+	fn(&s.res.Total)
+}
+
+// post handles a message or album posted at its date, like handleMessages.
+func (s *simulation) post(msgs []*tg.Message, snd sender) {
+	posted := time.Unix(int64(msgs[0].Date), 0)
+	s.flushDigest(posted)
+	s.res.Scanned++
+	s.count(posted, func(d *SimulationDay) { d.Scanned++ })
+	if !s.cr.match(msgs, snd) {
+		return
+	}
+	s.count(posted, func(d *SimulationDay) { d.Matched++ })
+
+	sample := SimulationSample{MessageID: msgs[0].ID, Date: posted, Text: sampleText(msgs)}
+	at, ok := s.cr.admit(posted)
+	if !ok {
+		s.count(posted, func(d *SimulationDay) { d.OutsideSchedule++ })
+		sample.Outcome = OutcomeOutsideSchedule
+		s.res.Matches = appendSample(s.res.Matches, sample)
+		return
+	}
+
+	if s.cr.digest != nil {
+		if s.digestCount == 0 {
+			s.digestSince = posted
+		}
+		s.digestCount++
+		sample.Outcome = OutcomeHeld
+		sample.Delay = int(s.cr.digest.next(s.digestSince, s.cr.schedule.loc).Sub(posted).Seconds())
+		s.res.Matches = appendSample(s.res.Matches, sample)
+		return
+	}
+
+	fp := fingerprint(msgs)
+	for _, t := range s.targets {
+		sample := sample
+		sample.Target = t.target.TargetName
+		if t.delivered(msgs) || t.duplicate(fp, posted) {
+			s.count(posted, func(d *SimulationDay) { d.Duplicates++ })
+			sample.Outcome = OutcomeDuplicate
+			s.res.Matches = appendSample(s.res.Matches, sample)
+			continue
+		}
+		if t.target.DedupHours > 0 && fp != "" {
+			t.seen[fp] = append(t.seen[fp], posted)
+		}
+		s.deliver(t, posted, at, true, &sample)
+		s.res.Matches = appendSample(s.res.Matches, sample)
+	}
+}
+
+// newSimTarget starts the simulated stream to a target from its real
+// deliveries: the history messages the rule delivered to it, like
+// notForwarded, and the content any rule delivered within its dedup window
+// before the simulation starts, like duplicateContent.
+func (e *Engine) newSimTarget(ruleID uint, target storage.ForwardTarget, history []tg.MessageClass, since time.Time) (*simTarget, error) {
+	t := &simTarget{target: target, forwarded: make(map[int]bool), seen: make(map[string][]time.Time)}
+	if ruleID != 0 && target.ID != 0 && len(history) > 0 {
+		var ids []int
+		err := e.db.Model(&storage.ForwardLog{}).
+			Where("rule_id = ? AND target_id = ? AND message_id >= ? AND status IN ?",
+				ruleID, target.ID, history[len(history)-1].GetID(),
+				[]string{storage.ForwardStatusSent, storage.ForwardStatusSkipped}).
+			Pluck("message_id", &ids).Error
+		if err != nil {
+			return nil, fmt.Errorf("load forward log: %w", err)
+		}
+		for _, id := range ids {
+			t.forwarded[id] = true
+		}
+	}
+
+	if target.DedupHours > 0 {
+		var logs []storage.ForwardLog
+		err := e.deliveredTo(target).
+			Where("fingerprint <> '' AND created_at > ?", since.Add(-time.Duration(target.DedupHours)*time.Hour)).
+			Select("fingerprint", "created_at").Order("created_at").Find(&logs).Error
+		if err != nil {
+			return nil, fmt.Errorf("load delivered content: %w", err)
+		}
+		for _, l := range logs {
+			t.seen[l.Fingerprint] = append(t.seen[l.Fingerprint], l.CreatedAt)
+		}
+	}
+	return t, nil
+}
+
+// delivered reports whether the rule delivered all parts of the post to the
+// target before.
+func (t *simTarget) delivered(msgs []*tg.Message) bool {
+	return !slices.ContainsFunc(msgs, func(m *tg.Message) bool { return !t.forwarded[m.ID] })
+}
+
+// duplicate reports whether content with the fingerprint reached the target
+// within its dedup window before at.
+func (t *simTarget) duplicate(fp string, at time.Time) bool {
+	if t.target.DedupHours <= 0 || fp == "" {
+		return false
+	}
+	window := time.Duration(t.target.DedupHours) * time.Hour
+	return slices.ContainsFunc(t.seen[fp], func(d time.Time) bool {
+		return !d.After(at) && at.Sub(d) < window
+	})
+}
+
+// deliver simulates the outbox stream of the target: items go out one after
+// another and within the rate limit; sends only while the schedule is open.
+// Posts are counted on the day they were posted.
+func (s *simulation) deliver(t *simTarget, posted, at time.Time, send bool, sample *SimulationSample) {
+	held := at.After(posted)
+	at = maxTime(at, t.free)
+	if send && !s.cr.schedule.active(at) {
+		if next := s.cr.schedule.nextOpen(at); !next.IsZero() {
+			at, held = next, true
+		}
+	}
+	if t.bucket == nil {
+		t.bucket = newTokenBucket(effectiveRateLimit(s.cr.rule, t.target), at)
+	}
+	limited := false
+	if wait := t.bucket.take(at); wait > 0 {
+		at = at.Add(wait)
+		t.bucket.take(at)
+		limited = true
+	}
+	t.free = at
+
+	sample.Delay = int(at.Sub(posted).Seconds())
+	s.count(posted, func(d *SimulationDay) {
+		d.Delivered++
+		switch {
+		case limited:
+			d.RateLimited++
+		case held:
+			d.Held++
+		}
+	})
+	switch {
+	case limited:
+		sample.Outcome = OutcomeRateLimited
+		s.res.RateLimited = appendSample(s.res.RateLimited, *sample)
+	case held:
+		sample.Outcome = OutcomeHeld
+	default:
+		sample.Outcome = OutcomeDelivered
+	}
+}
+
+// flushDigest posts the collected digest entries if a posting time has
+// passed by now, like processDigests.
+func (s *simulation) flushDigest(now time.Time) {
+	if s.cr.digest == nil || s.digestCount == 0 {
+		return
+	}
+	at := s.cr.digest.next(s.digestSince, s.cr.schedule.loc)
+	if at.IsZero() || now.Before(at) {
+		return
+	}
+	for _, t := range s.targets {
+		var sample SimulationSample
+		s.deliver(t, at, at, false, &sample)
+	}
+	s.digestCount = 0
+}
+
+// sampleText returns the first line of the post's text, shortened.
+func sampleText(msgs []*tg.Message) string {
+	return newDigestEntry(storage.ForwardRule{}, msgs, sender{}).Text
+}
+
+// appendSample keeps the latest simulateSamples samples.
+func appendSample(samples []SimulationSample, s SimulationSample) []SimulationSample {
+	samples = append(samples, s)
+	if len(samples) > simulateSamples {
+		samples = samples[len(samples)-simulateSamples:]
+	}
+	return samples
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
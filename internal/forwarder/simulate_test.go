@@ -0,0 +1,45 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+func TestSimTargetDedup(t *testing.T) {
+	base := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	st := &simTarget{
+		target:    storage.ForwardTarget{DedupHours: 2},
+		forwarded: map[int]bool{10: true, 11: true},
+		// Delivered for real, by any rule
+		seen: map[string][]time.Time{"fp": {base, base.Add(5 * time.Hour)}},
+	}
+
+	dups := []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"before the delivery", base.Add(-time.Minute), false},
+		{"within the window", base.Add(time.Hour), true},
+		{"after the window", base.Add(3 * time.Hour), false},
+		{"within a later delivery's window", base.Add(6 * time.Hour), true},
+	}
+	for _, tt := range dups {
+		if got := st.duplicate("fp", tt.at); got != tt.want {
+			t.Errorf("%s: duplicate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if st.duplicate("other", base) {
+		t.Error("other content is a duplicate")
+	}
+
+	if !st.delivered([]*tg.Message{{ID: 10}, {ID: 11}}) {
+		t.Error("album delivered before is not delivered")
+	}
+	if st.delivered([]*tg.Message{{ID: 11}, {ID: 12}}) {
+		t.Error("album with an undelivered part is delivered")
+	}
+}
@@ -0,0 +1,63 @@
+package forwarder
+
+import "github.com/gotd/td/tg"
+
+// generalTopicID is the ID of the General topic of a forum. Messages of
+// chats that are no forums count as posted in it.
+const generalTopicID = 1
+
+// topicOf returns the forum topic a message was posted in.
+func topicOf(m *tg.Message) int {
+	h, ok := m.ReplyTo.(*tg.MessageReplyHeader)
+	if !ok || !h.ForumTopic {
+		return generalTopicID
+	}
+	if h.ReplyToTopID != 0 {
+		// A reply inside the topic
+		return h.ReplyToTopID
+	}
+	return h.ReplyToMsgID
+}
+
+// replyOf returns the ID of the message in the same chat that m replies to,
+// or 0. Posts that merely start a thread in a forum topic are no replies.
+func replyOf(m *tg.Message) int {
+	h, ok := m.ReplyTo.(*tg.MessageReplyHeader)
+	if !ok || h.ReplyToPeerID != nil {
+		return 0
+	}
+	if h.ForumTopic && h.ReplyToTopID == 0 {
+		return 0
+	}
+	return h.ReplyToMsgID
+}
+
+// placement says where a message goes in the target: the forum topic (0 for
+// none) and the target message it replies to (0 for none).
+type placement struct {
+	topic   int
+	replyTo int
+}
+
+// inputReplyTo returns the reply header of the placement, or nil for a
+// plain message in the General topic.
+func (p placement) inputReplyTo() tg.InputReplyToClass {
+	topic := p.topMsgID()
+	switch {
+	case p.replyTo != 0:
+		return &tg.InputReplyToMessage{ReplyToMsgID: p.replyTo, TopMsgID: topic}
+	case topic != 0:
+		return &tg.InputReplyToMessage{ReplyToMsgID: topic}
+	default:
+		return nil
+	}
+}
+
+// topMsgID returns the topic for requests that take it separately, such as
+// forwards.
+func (p placement) topMsgID() int {
+	if p.topic <= generalTopicID {
+		return 0
+	}
+	return p.topic
+}
@@ -0,0 +1,194 @@
+package forwarder
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+// templateData is the data available to prefix/suffix templates, e.g.
+// {{.Source}}, {{.Link}}, {{.Date}} or {{index .Groups "name"}}.
+type templateData struct {
+	Source string
+	Link   string
+	// Date is the message's date as "2006-01-02 15:04" in the time zone of
+	// the rule's schedule, UTC when it has none.
+	Date   string
+	Groups map[string]string
+}
+
+// hasTransforms reports whether the rule modifies message text.
+func (c *compiledRule) hasTransforms() bool {
+	return len(c.replacements) > 0 || c.prefix != nil || c.suffix != nil
+}
+
+// transform applies the rule's replacements and templates to msg and returns
+// a shallow copy with the new text. Entity offsets are remapped so formatting
+// stays on the same text after rewriting.
+func (c *compiledRule) transform(msg *tg.Message) (*tg.Message, error) {
+	if !c.hasTransforms() {
+		return msg, nil
+	}
+	rule := c.rule
+
+	text, entities := msg.Message, msg.Entities
+	for _, r := range c.replacements {
+		text, entities = replaceText(r.re, r.replacement, text, entities)
+	}
+
+	data := templateData{
+		Source: rule.SourceName,
+		Link:   messageLink(rule, msg.ID),
+		Date:   time.Unix(int64(msg.Date), 0).In(c.schedule.loc).Format("2006-01-02 15:04"),
+		Groups: c.groups(msg.Message),
+	}
+	prefix, err := execTemplate(c.prefix, data)
+	if err != nil {
+		return nil, err
+	}
+	suffix, err := execTemplate(c.suffix, data)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		shift := utf16Len(prefix)
+		shifted := make([]tg.MessageEntityClass, 0, len(entities))
+		for _, ent := range entities {
+			shifted = append(shifted, withRange(ent, ent.GetOffset()+shift, ent.GetLength()))
+		}
+		text, entities = prefix+text, shifted
+	}
+	text += suffix
+
+	out := *msg
+	out.Message = text
+	out.Entities = entities
+	return &out, nil
+}
+
+// transformAlbum applies transform to the captioned part of an album.
+func (c *compiledRule) transformAlbum(msgs []*tg.Message) ([]*tg.Message, error) {
+	out := slices.Clone(msgs)
+	i := captionIndex(out)
+	m, err := c.transform(out[i])
+	if err != nil {
+		return nil, err
+	}
+	out[i] = m
+	return out, nil
+}
+
+func execTemplate(t *template.Template, data templateData) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("execute %s template: %w", t.Name(), err)
+	}
+	return b.String(), nil
+}
+
+// messageLink returns a t.me link to a channel message, usable by members.
+// Messages of basic groups and private chats have no links.
+func messageLink(rule storage.ForwardRule, msgID int) string {
+	if !isChannel(rule.SourceType) {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/c/%d/%d", rule.SourceChannelID, msgID)
+}
+
+// textEdit describes replacing old text [start, end) with newLen code units.
+// All values are in UTF-16 code units, as used by Telegram entities.
+type textEdit struct {
+	start, end, newLen int
+}
+
+// replaceText replaces all matches of re in text and remaps entities.
+func replaceText(re *regexp.Regexp, replacement, text string, entities []tg.MessageEntityClass) (string, []tg.MessageEntityClass) {
+	matches := re.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, entities
+	}
+
+	var (
+		b     strings.Builder
+		edits []textEdit
+		last  int
+		pos16 int // UTF-16 offset of text[last:]
+	)
+	for _, m := range matches {
+		b.WriteString(text[last:m[0]])
+		start := pos16 + utf16Len(text[last:m[0]])
+		end := start + utf16Len(text[m[0]:m[1]])
+		repl := string(re.ExpandString(nil, replacement, text, m))
+		b.WriteString(repl)
+		edits = append(edits, textEdit{start: start, end: end, newLen: utf16Len(repl)})
+		last, pos16 = m[1], end
+	}
+	b.WriteString(text[last:])
+
+	return b.String(), remapEntities(entities, edits)
+}
+
+// remapEntities moves entity boundaries through the given sorted,
+// non-overlapping edits. A boundary inside a replaced range snaps to the
+// edge of the replacement; entities that become empty are dropped.
+func remapEntities(entities []tg.MessageEntityClass, edits []textEdit) []tg.MessageEntityClass {
+	mapPos := func(pos int, isEnd bool) int {
+		shift := 0
+		for _, e := range edits {
+			if pos >= e.end {
+				shift += e.newLen - (e.end - e.start)
+				continue
+			}
+			if pos <= e.start {
+				break
+			}
+			if isEnd {
+				return e.start + shift + e.newLen
+			}
+			return e.start + shift
+		}
+		return pos + shift
+	}
+
+	result := make([]tg.MessageEntityClass, 0, len(entities))
+	for _, ent := range entities {
+		start := mapPos(ent.GetOffset(), false)
+		end := mapPos(ent.GetOffset()+ent.GetLength(), true)
+		if end <= start {
+			continue
+		}
+		result = append(result, withRange(ent, start, end-start))
+	}
+	return result
+}
+
+// withRange returns a copy of the entity with a new offset and length.
+// Entities are distinct generated types, so this goes through reflection
+// (as gotd's own entity builder does).
+func withRange(ent tg.MessageEntityClass, offset, length int) tg.MessageEntityClass {
+	v := reflect.New(reflect.TypeOf(ent).Elem())
+	v.Elem().Set(reflect.ValueOf(ent).Elem())
+	v.Elem().FieldByName("Offset").SetInt(int64(offset))
+	v.Elem().FieldByName("Length").SetInt(int64(length))
+	return v.Interface().(tg.MessageEntityClass)
+}
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
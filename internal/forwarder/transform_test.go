@@ -0,0 +1,274 @@
+package forwarder
+
+import (
+	"regexp"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+// span is an entity range in UTF-16 code units.
+type span struct{ offset, length int }
+
+func bold(offset, length int) tg.MessageEntityClass {
+	return &tg.MessageEntityBold{Offset: offset, Length: length}
+}
+
+func spans(entities []tg.MessageEntityClass) []span {
+	out := make([]span, 0, len(entities))
+	for _, ent := range entities {
+		out = append(out, span{ent.GetOffset(), ent.GetLength()})
+	}
+	return out
+}
+
+// entityText returns the text an entity covers.
+func entityText(text string, ent tg.MessageEntityClass) string {
+	u := utf16.Encode([]rune(text))
+	return string(utf16.Decode(u[ent.GetOffset() : ent.GetOffset()+ent.GetLength()]))
+}
+
+func TestReplaceText(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		replacement string
+		text        string
+		entities    []tg.MessageEntityClass
+		wantText    string
+		want        []span
+		wantCovered []string
+	}{
+		{
+			name:        "shorter before entity after emoji",
+			pattern:     `hello`,
+			replacement: "hi",
+			text:        "😀 hello world",
+			entities:    []tg.MessageEntityClass{bold(9, 5)},
+			wantText:    "😀 hi world",
+			want:        []span{{6, 5}},
+			wantCovered: []string{"world"},
+		},
+		{
+			name:        "longer before entity",
+			pattern:     `a`,
+			replacement: "🅰️",
+			text:        "a b",
+			entities:    []tg.MessageEntityClass{bold(2, 1)},
+			wantText:    "🅰️ b",
+			want:        []span{{4, 1}},
+			wantCovered: []string{"b"},
+		},
+		{
+			name:        "inside entity with surrogate pairs",
+			pattern:     `bold`,
+			replacement: "🔥",
+			text:        "a 👍bold text👍 z",
+			entities:    []tg.MessageEntityClass{bold(2, 13)},
+			wantText:    "a 👍🔥 text👍 z",
+			want:        []span{{2, 11}},
+			wantCovered: []string{"👍🔥 text👍"},
+		},
+		{
+			name:        "across entity start",
+			pattern:     `o b`,
+			replacement: "X",
+			text:        "foo bar",
+			entities:    []tg.MessageEntityClass{bold(4, 3)},
+			wantText:    "foXar",
+			want:        []span{{2, 3}},
+			wantCovered: []string{"Xar"},
+		},
+		{
+			name:        "across entity end",
+			pattern:     `r b`,
+			replacement: "😀",
+			text:        "foo bar baz",
+			entities:    []tg.MessageEntityClass{bold(4, 3)},
+			wantText:    "foo ba😀az",
+			want:        []span{{4, 4}},
+			wantCovered: []string{"ba😀"},
+		},
+		{
+			name:        "entity removed with its text",
+			pattern:     `bar `,
+			replacement: "",
+			text:        "foo bar baz",
+			entities:    []tg.MessageEntityClass{bold(4, 3), bold(8, 3)},
+			wantText:    "foo baz",
+			want:        []span{{4, 3}},
+			wantCovered: []string{"baz"},
+		},
+		{
+			name:        "several matches with flags",
+			pattern:     `🇩🇪`,
+			replacement: "DE",
+			text:        "🇩🇪 x 🇩🇪 y",
+			entities:    []tg.MessageEntityClass{bold(5, 1), bold(12, 1)},
+			wantText:    "DE x DE y",
+			want:        []span{{3, 1}, {8, 1}},
+			wantCovered: []string{"x", "y"},
+		},
+		{
+			name:        "named group in replacement",
+			pattern:     `(?P<amount>\d+)€`,
+			replacement: "EUR ${amount}",
+			text:        "💶 5€ now",
+			entities:    []tg.MessageEntityClass{bold(6, 3)},
+			wantText:    "💶 EUR 5 now",
+			want:        []span{{9, 3}},
+			wantCovered: []string{"now"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, entities := replaceText(regexp.MustCompile(tt.pattern), tt.replacement, tt.text, tt.entities)
+			if text != tt.wantText {
+				t.Fatalf("text = %q, want %q", text, tt.wantText)
+			}
+			if got := spans(entities); !equalSpans(got, tt.want) {
+				t.Fatalf("entities = %v, want %v", got, tt.want)
+			}
+			for i, ent := range entities {
+				if got := entityText(text, ent); got != tt.wantCovered[i] {
+					t.Errorf("entity %d covers %q, want %q", i, got, tt.wantCovered[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        storage.ForwardRule
+		text        string
+		entities    []tg.MessageEntityClass
+		wantText    string
+		want        []span
+		wantCovered []string
+	}{
+		{
+			name: "prefix with named group",
+			rule: storage.ForwardRule{
+				MatchPattern:   `price (?P<price>\d+)`,
+				PrefixTemplate: `💰 {{index .Groups "price"}} | `,
+			},
+			text:        "🚀 price 42",
+			entities:    []tg.MessageEntityClass{bold(3, 5)},
+			wantText:    "💰 42 | 🚀 price 42",
+			want:        []span{{11, 5}},
+			wantCovered: []string{"price"},
+		},
+		{
+			name: "suffix keeps offsets",
+			rule: storage.ForwardRule{
+				SourceName:     "Новости 📰",
+				MatchPattern:   `.`,
+				SuffixTemplate: "\n— {{.Source}}",
+			},
+			text:        "👋 hi",
+			entities:    []tg.MessageEntityClass{bold(3, 2)},
+			wantText:    "👋 hi\n— Новости 📰",
+			want:        []span{{3, 2}},
+			wantCovered: []string{"hi"},
+		},
+		{
+			name: "replacement then prefix and suffix",
+			rule: storage.ForwardRule{
+				MatchPattern:   `(?P<tag>#\w+)`,
+				Replacements:   []storage.TextReplacement{{Pattern: `\s*#\w+`, Replacement: ""}},
+				PrefixTemplate: `[{{index .Groups "tag"}}] `,
+				SuffixTemplate: " ✅",
+			},
+			text:        "🔔 alert #ops now",
+			entities:    []tg.MessageEntityClass{bold(3, 5), bold(14, 3)},
+			wantText:    "[#ops] 🔔 alert now ✅",
+			want:        []span{{10, 5}, {16, 3}},
+			wantCovered: []string{"alert", "now"},
+		},
+		{
+			name: "group missing from text",
+			rule: storage.ForwardRule{
+				MatchPattern:   `(?P<id>\d+)?x`,
+				PrefixTemplate: `{{index .Groups "id"}}😀`,
+			},
+			text:        "x y",
+			entities:    []tg.MessageEntityClass{bold(2, 1)},
+			wantText:    "😀x y",
+			want:        []span{{4, 1}},
+			wantCovered: []string{"y"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.DeliveryMode = storage.DeliveryModeCopy
+			cr, err := compileRule(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := cr.transform(&tg.Message{ID: 1, Message: tt.text, Entities: tt.entities})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Message != tt.wantText {
+				t.Fatalf("text = %q, want %q", out.Message, tt.wantText)
+			}
+			if got := spans(out.Entities); !equalSpans(got, tt.want) {
+				t.Fatalf("entities = %v, want %v", got, tt.want)
+			}
+			for i, ent := range out.Entities {
+				if got := entityText(out.Message, ent); got != tt.wantCovered[i] {
+					t.Errorf("entity %d covers %q, want %q", i, got, tt.wantCovered[i])
+				}
+			}
+		})
+	}
+}
+
+func equalSpans(a, b []span) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTemplateDateTimeZone(t *testing.T) {
+	if _, err := time.LoadLocation("Asia/Shanghai"); err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	date := int(time.Date(2026, 1, 1, 20, 30, 0, 0, time.UTC).Unix())
+	tests := []struct {
+		timezone string
+		want     string
+	}{
+		{"", "2026-01-01 20:30 x"},
+		{"Asia/Shanghai", "2026-01-02 04:30 x"},
+	}
+	for _, tt := range tests {
+		cr, err := compileRule(storage.ForwardRule{
+			MatchPattern:   "x",
+			DeliveryMode:   storage.DeliveryModeCopy,
+			PrefixTemplate: "{{.Date}} ",
+			Schedule:       storage.RuleSchedule{Timezone: tt.timezone},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cr.transform(&tg.Message{ID: 1, Message: "x", Date: date})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Message != tt.want {
+			t.Errorf("timezone %q: text = %q, want %q", tt.timezone, out.Message, tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gotd/td/tg"
+	"github.com/tg-manager/internal/storage"
+)
+
+const webhookTimeout = 15 * time.Second
+
+// Webhook request headers. The signature is "sha256=" followed by the hex
+// HMAC-SHA256 of the body, keyed with the target's secret. The delivery ID
+// stays the same across retries, so receivers can drop repeats.
+const (
+	webhookEventHeader     = "X-TG-Manager-Event"
+	webhookDeliveryHeader  = "X-TG-Manager-Delivery"
+	webhookSignatureHeader = "X-TG-Manager-Signature"
+)
+
+// Webhook events.
+const (
+	webhookEventMessage = "message"
+	webhookEventEdit    = "edit" // edited version of a delivered message, see ForwardRule.ForwardEdits
+	webhookEventDigest  = "digest"
+)
+
+// webhookPayload is the JSON body POSTed to webhook targets.
+type webhookPayload struct {
+	Event      string            `json:"event"`
+	DeliveryID uint              `json:"delivery_id"`
+	RuleID     uint              `json:"rule_id"`
+	Source     webhookSource     `json:"source"`
+	Message    *webhookMessage   `json:"message,omitempty"`
+	Sender     *webhookSender    `json:"sender,omitempty"`
+	Groups     map[string]string `json:"groups,omitempty"` // named capture groups of the match pattern
+	Digest     string            `json:"digest,omitempty"`
+	Timestamp  int64             `json:"timestamp"` // time of the request, unix seconds
+}
+
+type webhookSource struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// webhookMessage is a message or album. Entity offsets and lengths are in
+// UTF-16 code units, as in the Telegram API.
+type webhookMessage struct {
+	ID       int             `json:"id"`
+	IDs      []int           `json:"ids"` // all parts of an album
+	Date     int             `json:"date"`
+	EditDate int             `json:"edit_date,omitempty"`
+	TopicID  int             `json:"topic_id,omitempty"`
+	ReplyTo  int             `json:"reply_to,omitempty"`
+	Text     string          `json:"text"`
+	Entities []webhookEntity `json:"entities"`
+	Media    []string        `json:"media"` // storage.Media* kind of each part
+	Link     string          `json:"link,omitempty"`
+}
+
+// webhookEntity is a formatting entity; Type is the API type in snake case,
+// e.g. "bold", "text_url" or "mention_name".
+type webhookEntity struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	URL      string `json:"url,omitempty"`
+	UserID   int64  `json:"user_id,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+type webhookSender struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// webhookError is a non-2xx response of a webhook endpoint.
+type webhookError struct {
+	status     int
+	retryAfter time.Duration
+	body       string
+}
+
+func (e *webhookError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("webhook responded with status %d", e.status)
+	}
+	return fmt.Sprintf("webhook responded with status %d: %s", e.status, e.body)
+}
+
+// retryDelay tells how long to wait before retrying: rate limits and server
+// errors are retried, other client errors are permanent.
+func (e *webhookError) retryDelay(attempts int) (time.Duration, bool) {
+	switch {
+	case e.status == http.StatusTooManyRequests && e.retryAfter > 0:
+		return min(e.retryAfter, outboxMaxBackoff), true
+	case e.status == http.StatusTooManyRequests, e.status == http.StatusRequestTimeout, e.status >= 500:
+		return backoff(attempts), true
+	default:
+		return 0, false
+	}
+}
+
+// validateWebhookURL checks that a webhook target has an absolute HTTP(S)
+// URL.
+func validateWebhookURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid webhook_url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook_url must be an http or https URL")
+	}
+	return nil
+}
+
+// postMessages delivers a message or album to a webhook target.
+func (e *Engine) postMessages(ctx context.Context, item storage.OutboxItem, msgs []*tg.Message, rule storage.ForwardRule, target storage.ForwardTarget, cr *compiledRule) error {
+	text := groupText(msgs)
+	first := msgs[0]
+	msg := &webhookMessage{
+		ID:       first.ID,
+		Date:     first.Date,
+		EditDate: item.EditDate,
+		TopicID:  topicOf(first),
+		ReplyTo:  replyOf(first),
+		Text:     text,
+		Entities: []webhookEntity{},
+		Link:     messageLink(rule, first.ID),
+	}
+	for _, m := range msgs {
+		msg.IDs = append(msg.IDs, m.ID)
+		msg.Media = append(msg.Media, describeMedia(m).kind)
+	}
+	// Entities of an album caption only line up with the text when it is
+	// the only caption
+	if c := msgs[captionIndex(msgs)]; c.Message == text {
+		msg.Entities = webhookEntities(c.Entities)
+	}
+
+	event := webhookEventMessage
+	if item.EditDate != 0 {
+		event = webhookEventEdit
+	}
+	payload := webhookPayload{
+		Event:      event,
+		DeliveryID: item.ID,
+		RuleID:     rule.ID,
+		Source:     webhookSource{ID: rule.SourceChannelID, Type: rule.SourceType, Name: rule.SourceName},
+		Message:    msg,
+		Groups:     cr.groups(text),
+	}
+	if item.SenderID != 0 || item.SenderName != "" {
+		payload.Sender = &webhookSender{ID: item.SenderID, Name: item.SenderName}
+	}
+	return e.postWebhook(ctx, target, payload)
+}
+
+// postWebhook POSTs the payload to the target's URL, signed with its secret.
+func (e *Engine) postWebhook(ctx context.Context, target storage.ForwardTarget, payload webhookPayload) error {
+	payload.Timestamp = time.Now().Unix()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode webhook payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tg-manager")
+	req.Header.Set(webhookEventHeader, payload.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(uint64(payload.DeliveryID), 10))
+	if target.WebhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(target.WebhookSecret, body))
+	}
+
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return nil
+	}
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	werr := &webhookError{status: resp.StatusCode, body: strings.TrimSpace(string(snippet))}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		werr.retryAfter = time.Duration(secs) * time.Second
+	}
+	return werr
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookEntities(ents []tg.MessageEntityClass) []webhookEntity {
+	out := make([]webhookEntity, 0, len(ents))
+	for _, ent := range ents {
+		w := webhookEntity{
+			Type:   snakeCase(strings.TrimPrefix(ent.TypeName(), "messageEntity")),
+			Offset: ent.GetOffset(),
+			Length: ent.GetLength(),
+		}
+		switch ent := ent.(type) {
+		case *tg.MessageEntityTextURL:
+			w.URL = ent.URL
+		case *tg.MessageEntityMentionName:
+			w.UserID = ent.UserID
+		case *tg.MessageEntityPre:
+			w.Language = ent.Language
+		}
+		out = append(out, w)
+	}
+	return out
+}
+
+// snakeCase turns "TextURL" or "MentionName" into "text_url" and
+// "mention_name".
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// Start a word at the first capital of a word or acronym
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
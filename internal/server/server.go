@@ -25,10 +25,12 @@ func NewServer(st *storage.Storage, conf conf.Config) *Server {
 
 	// 2. Create Telegram service (passes engine as update handler)
 	sessionStorage := telegram.NewPostgresSessionStorage(st.GetDB())
+	updateStorage := telegram.NewPostgresUpdateStorage(st.GetDB())
 	tgSvc := telegram.NewService(
 		conf.TelegramConfiguration.AppID,
 		conf.TelegramConfiguration.AppHash,
 		sessionStorage,
+		updateStorage,
 		engine,
 	)
 
@@ -63,6 +65,12 @@ func (s *Server) Run(ctx context.Context) error {
 		log.Error().Err(err).Msg("Failed to load forwarding rules")
 	}
 
+	// Deliver queued messages, including those left over from a previous run
+	s.engine.Start()
+
+	// Continue backfills interrupted by the last shutdown
+	s.engine.ResumeBackfills()
+
 	// Start HTTP server (blocking)
 	return s.apiServer.Run()
 }
@@ -1,30 +1,354 @@
 package storage
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+// Delivery modes for ForwardRule.DeliveryMode.
+const (
+	// DeliveryModeForward forwards the original message, keeping the
+	// "Forwarded from" header.
+	DeliveryModeForward = "forward"
+	// DeliveryModeCopy re-sends the message content as a new message.
+	DeliveryModeCopy = "copy"
+	// DeliveryModeDigest collects matches and posts a summary of them on the
+	// rule's Digest schedule.
+	DeliveryModeDigest = "digest"
+)
+
+// Media kinds for ForwardRule.MediaTypes.
+const (
+	MediaText      = "text" // no media, or only a link preview
+	MediaPhoto     = "photo"
+	MediaVideo     = "video"
+	MediaAnimation = "animation"
+	MediaAudio     = "audio"
+	MediaVoice     = "voice"
+	MediaSticker   = "sticker"
+	MediaDocument  = "document"
+	MediaOther     = "other" // polls, geo points, contacts, ...
+)
+
+// Peer types for ForwardRule.SourceType and ForwardTarget.TargetType, as
+// reported by dialogs.list.
+const (
+	PeerTypeChannel    = "channel"
+	PeerTypeSupergroup = "supergroup"
+	PeerTypeGroup      = "group" // basic groups
+	PeerTypeUser       = "user"  // private chats
+	PeerTypeSelf       = "self"  // Saved Messages; targets only
+	// PeerTypeWebhook targets are HTTP endpoints, not chats; see
+	// ForwardTarget.WebhookURL.
+	PeerTypeWebhook = "webhook"
+)
 
 type ForwardRule struct {
+	ID uint `gorm:"primaryKey" json:"id"`
+	// SourceChannelID is the ID of the source chat, whatever its SourceType.
+	SourceChannelID int64  `gorm:"index;not null" json:"source_channel_id"`
+	SourceType      string `gorm:"not null;default:channel" json:"source_type"`
+	SourceName      string `json:"source_name"`
+	SourceHash      int64  `json:"source_hash,string"`
+	// SourceTopicIDs limits forum sources to these topics; 1 is General.
+	SourceTopicIDs []int  `gorm:"type:jsonb;serializer:json" json:"source_topic_ids"`
+	MatchPattern   string `gorm:"not null" json:"match_pattern"`
+	// Conditions must hold in addition to MatchPattern.
+	Conditions   RuleConditions `gorm:"type:jsonb;serializer:json" json:"conditions"`
+	Senders      SenderFilter   `gorm:"type:jsonb;serializer:json" json:"senders"`
+	DeliveryMode string         `gorm:"not null;default:forward" json:"delivery_mode"`
+	// Text transforms, applied to copies only (see DeliveryModeCopy).
+	Replacements   []TextReplacement `gorm:"type:jsonb;serializer:json" json:"replacements"`
+	PrefixTemplate string            `json:"prefix_template"`
+	SuffixTemplate string            `json:"suffix_template"`
+	// Media filters; empty values match everything. MediaTypes limits the
+	// kinds of posts. MimeTypes ("image/*", "application/pdf"),
+	// FileNamePattern and MinSize/MaxSize (bytes) only pass messages that
+	// carry a file.
+	MediaTypes      []string `gorm:"type:jsonb;serializer:json" json:"media_types"`
+	MimeTypes       []string `gorm:"type:jsonb;serializer:json" json:"mime_types"`
+	FileNamePattern string   `json:"file_name_pattern"`
+	MinSize         int64    `json:"min_size"`
+	MaxSize         int64    `json:"max_size"`
+	// Rate limit per target: at most RateLimit deliveries per RatePeriod
+	// seconds, with bursts of up to RateBurst. RateLimit 0 disables it.
+	// Excess matches are queued, not dropped.
+	RateLimit  int `json:"rate_limit"`
+	RatePeriod int `json:"rate_period"`
+	RateBurst  int `json:"rate_burst"`
+	// Edits of delivered copies are always applied to the copy. With
+	// ForwardEdits, forward-mode rules forward the edited version again.
+	ForwardEdits bool `json:"forward_edits"`
+	// SyncDeletes deletes the delivered messages when the source deletes the
+	// original.
+	SyncDeletes bool `json:"sync_deletes"`
+	Enabled     bool `gorm:"default:true" json:"enabled"`
+	// Schedule limits when the enabled rule forwards.
+	Schedule RuleSchedule `gorm:"type:jsonb;serializer:json" json:"schedule"`
+	// Digest configures DeliveryModeDigest.
+	Digest DigestConfig `gorm:"type:jsonb;serializer:json" json:"digest"`
+	// ActiveNow is computed for API responses: enabled and inside the
+	// schedule.
+	ActiveNow bool            `gorm:"-" json:"active_now"`
+	Targets   []ForwardTarget `gorm:"foreignKey:RuleID;constraint:OnDelete:CASCADE" json:"targets"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// ForwardTarget is one destination of a ForwardRule.
+type ForwardTarget struct {
+	ID              uint   `gorm:"primaryKey" json:"id"`
+	RuleID          uint   `gorm:"index;not null" json:"rule_id"`
+	TargetChannelID int64  `gorm:"not null" json:"target_channel_id"` // 0 for Saved Messages
+	TargetType      string `gorm:"not null;default:channel" json:"target_type"`
+	TargetName      string `json:"target_name"`
+	TargetHash      int64  `json:"target_hash,string"`
+	TopicID         int    `json:"topic_id"` // forum topic to post into; 0 for none
+	// Webhook targets receive matches as JSON POSTs to WebhookURL. With a
+	// WebhookSecret, requests carry the HMAC-SHA256 of the body. The secret
+	// is never returned, see MarshalJSON.
+	WebhookURL    string `json:"webhook_url"`
+	WebhookSecret string `json:"-"`
+	// DedupHours skips messages whose content (text and media) the target
+	// received within that many hours, from any rule. 0 disables it.
+	DedupHours int `json:"dedup_hours"`
+	// Optional rate limit overriding the rule's; see ForwardRule.
+	RateLimit  int       `json:"rate_limit"`
+	RatePeriod int       `json:"rate_period"`
+	RateBurst  int       `json:"rate_burst"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// MarshalJSON encodes the target with has_webhook_secret in place of the
+// secret itself.
+func (t ForwardTarget) MarshalJSON() ([]byte, error) {
+	type target ForwardTarget
+	return json.Marshal(struct {
+		target
+		HasWebhookSecret bool `json:"has_webhook_secret"`
+	}{target(t), t.WebhookSecret != ""})
+}
+
+// RuleConditions are structured text conditions. Every non-empty group must
+// hold: All requires each regex to match, Any at least one, None none of them.
+// Keywords and ExcludeKeywords are plain text: at least one keyword has to
+// occur and no excluded one may.
+type RuleConditions struct {
+	All             []string `json:"all"`
+	Any             []string `json:"any"`
+	None            []string `json:"none"`
+	Keywords        []string `json:"keywords"`
+	ExcludeKeywords []string `json:"exclude_keywords"`
+	IgnoreCase      bool     `json:"ignore_case"` // for regexes and keywords
+	WholeWord       bool     `json:"whole_word"`  // keywords only match whole words
+}
+
+// SenderFilter limits a rule to posts by certain authors. A message passes
+// the allow lists when they are all empty or any entry matches its sender,
+// and is rejected when any deny entry matches. Authors are the signatures of
+// channel posts (post_author); usernames are compared without "@" and case.
+type SenderFilter struct {
+	AllowIDs       []int64  `json:"allow_ids"`
+	AllowUsernames []string `json:"allow_usernames"`
+	AllowAuthors   []string `json:"allow_authors"`
+	DenyIDs        []int64  `json:"deny_ids"`
+	DenyUsernames  []string `json:"deny_usernames"`
+	DenyAuthors    []string `json:"deny_authors"`
+	DenyBots       bool     `json:"deny_bots"`
+}
+
+// What happens to matches outside of a rule's schedule.
+const (
+	ScheduleDrop = "drop"
+	ScheduleHold = "hold" // queue until the next window opens
+)
+
+// RuleSchedule limits when an enabled rule forwards. Without windows the rule
+// is active all day, except on blackout dates.
+type RuleSchedule struct {
+	Timezone  string           `json:"timezone"`  // IANA name; UTC when empty
+	Windows   []ScheduleWindow `json:"windows"`   // active when any window is open
+	Blackouts []string         `json:"blackouts"` // dates as "2006-01-02"
+	Outside   string           `json:"outside"`   // ScheduleDrop (default) or ScheduleHold
+}
+
+// ScheduleWindow is a daily time range. A window whose End is before its
+// Start runs past midnight into the next day.
+type ScheduleWindow struct {
+	Days  []int  `json:"days"`  // 0 = Sunday; empty means every day
+	Start string `json:"start"` // "09:00"
+	End   string `json:"end"`   // "18:00"
+}
+
+// DigestConfig says when a digest rule posts its summary: every Interval
+// minutes, or daily at the times in At, in the timezone of the rule's
+// schedule.
+type DigestConfig struct {
+	Interval int      `json:"interval"`  // minutes
+	At       []string `json:"at"`        // "09:00"
+	Title    string   `json:"title"`     // first line; defaults to the source name
+	MaxItems int      `json:"max_items"` // listed entries per post; 0 for 30
+}
+
+// TextReplacement is a regex find/replace step. Replacement may reference
+// capture groups of Pattern ($1, ${name}).
+type TextReplacement struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// Delivery statuses for ForwardLog.Status.
+const (
+	ForwardStatusSent   = "sent"
+	ForwardStatusFailed = "failed"
+	// ForwardStatusSkipped marks content the target already received from
+	// another message within its dedup window.
+	ForwardStatusSkipped = "skipped"
+)
+
+// ForwardLog records the delivery of a source message to one target of a rule.
+type ForwardLog struct {
 	ID              uint      `gorm:"primaryKey" json:"id"`
-	SourceChannelID int64     `gorm:"index;not null" json:"source_channel_id"`
-	SourceName      string    `json:"source_name"`
-	SourceHash      int64     `json:"source_hash,string"`
+	RuleID          uint      `gorm:"uniqueIndex:idx_rule_target_msg;not null" json:"rule_id"`
+	TargetID        uint      `gorm:"uniqueIndex:idx_rule_target_msg;not null;default:0" json:"target_id"`
+	MessageID       int       `gorm:"uniqueIndex:idx_rule_target_msg;not null" json:"message_id"`
+	SourceChannelID int64     `gorm:"not null" json:"source_channel_id"`
 	TargetChannelID int64     `gorm:"not null" json:"target_channel_id"`
-	TargetName      string    `json:"target_name"`
-	TargetHash      int64     `json:"target_hash,string"`
-	MatchPattern    string    `gorm:"not null" json:"match_pattern"`
-	Enabled         bool      `gorm:"default:true" json:"enabled"`
+	SenderID        int64     `json:"sender_id"`
+	SenderName      string    `json:"sender_name"`
+	Fingerprint     string    `gorm:"index" json:"fingerprint"`
+	Status          string    `gorm:"not null;default:sent" json:"status"`
+	Error           string    `json:"error"`
 	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
 }
 
-type ForwardLog struct {
-	ID              uint      `gorm:"primaryKey"`
-	RuleID          uint      `gorm:"uniqueIndex:idx_rule_msg;not null"`
-	MessageID       int       `gorm:"uniqueIndex:idx_rule_msg;not null"`
-	SourceChannelID int64     `gorm:"not null"`
-	TargetChannelID int64     `gorm:"not null"`
+// Outbox statuses for OutboxItem.Status.
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxDone    = "done"
+	OutboxFailed  = "failed"
+	// OutboxCancelled marks deliveries dropped because the source message
+	// was deleted.
+	OutboxCancelled = "cancelled"
+)
+
+// Outbox actions for OutboxItem.Action.
+const (
+	OutboxActionSend   = "send"
+	OutboxActionEdit   = "edit"   // apply a source edit to the delivered copy
+	OutboxActionDelete = "delete" // delete the delivered messages
+	OutboxActionDigest = "digest" // post a digest; Payload holds its text
+)
+
+// OutboxItem is a queued delivery of a source message, or all parts of an
+// album, to one target of a rule. Payload holds the TL-encoded source
+// messages so the delivery survives restarts. Deliveries caused by an edit
+// carry the edit date of the source message. The random IDs of a send are
+// stored before the first attempt, so Telegram ignores a retry of a send
+// that already went through.
+type OutboxItem struct {
+	ID            uint   `gorm:"primaryKey"`
+	RuleID        uint   `gorm:"uniqueIndex:idx_outbox_action;not null"`
+	TargetID      uint   `gorm:"uniqueIndex:idx_outbox_action;not null"`
+	MessageID     int    `gorm:"uniqueIndex:idx_outbox_action;not null"` // first message of an album
+	Action        string `gorm:"uniqueIndex:idx_outbox_action;not null;default:send"`
+	EditDate      int    `gorm:"uniqueIndex:idx_outbox_action;not null;default:0"`
+	MessageIDs    []int  `gorm:"type:jsonb;serializer:json"`
+	SenderID      int64
+	SenderName    string
+	Fingerprint   string    // content hash, see ForwardTarget.DedupHours
+	JobID         uint      `gorm:"index"`                      // BackfillJob that queued the item
+	RandomIDs     []int64   `gorm:"type:jsonb;serializer:json"` // one per message of MessageIDs; one for a digest
+	Payload       []byte    `gorm:"type:bytea;not null"`
+	Status        string    `gorm:"index;not null"`
+	Attempts      int       `gorm:"not null"`
+	NextAttemptAt time.Time `gorm:"not null"`
+	LastError     string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// DigestEntry is a match of a digest rule waiting for the next digest post.
+type DigestEntry struct {
+	ID         uint   `gorm:"primaryKey"`
+	RuleID     uint   `gorm:"uniqueIndex:idx_digest_entry;not null"`
+	MessageID  int    `gorm:"uniqueIndex:idx_digest_entry;not null"` // first message of an album
+	Text       string // first line of the text or caption
+	Link       string // t.me link to the original, if it has one
+	SenderName string
+	PostedAt   time.Time  // date of the source message
+	DigestedAt *time.Time `gorm:"index"` // set once included in a post
+	CreatedAt  time.Time
+}
+
+// MessageMapping links a delivered source message to the message it produced
+// in the target. Edits, deletes and replies in copies are resolved through
+// it.
+type MessageMapping struct {
+	ID              uint `gorm:"primaryKey"`
+	RuleID          uint `gorm:"uniqueIndex:idx_mapping_source;not null"`
+	TargetID        uint `gorm:"uniqueIndex:idx_mapping_source;not null"`
+	SourceMessageID int  `gorm:"uniqueIndex:idx_mapping_source;not null"`
+	TargetMessageID int  `gorm:"not null"`
 	CreatedAt       time.Time
 }
 
+// Backfill job statuses for BackfillJob.Status.
+const (
+	BackfillRunning   = "running"
+	BackfillDone      = "done"
+	BackfillFailed    = "failed"
+	BackfillCancelled = "cancelled"
+)
+
+// BackfillJob scans the history of a rule's source chat, newest first, and
+// queues matches in the outbox. Cursor is the oldest message scanned so far;
+// an interrupted job resumes below it.
+type BackfillJob struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	RuleID        uint       `gorm:"index;not null" json:"rule_id"`
+	Limit         int        `gorm:"column:scan_limit;not null" json:"limit"` // messages to scan
+	Since         *time.Time `json:"since"`
+	Until         *time.Time `json:"until"`
+	FromMessageID int        `json:"from_message_id"`
+	Status        string     `gorm:"index;not null" json:"status"`
+	Cursor        int        `json:"cursor"`
+	Scanned       int        `json:"scanned"`
+	Matched       int        `json:"matched"`
+	Queued        int        `json:"queued"`    // outbox items, one per match and target; digest entries
+	Forwarded     int        `json:"forwarded"` // queued items delivered so far
+	Error         string     `json:"error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+}
+
+// UpdateState is the update sequence of the logged-in account. It lets the
+// client fetch updates it missed while offline.
+type UpdateState struct {
+	UserID int64 `gorm:"primaryKey;autoIncrement:false"`
+	Pts    int   `gorm:"not null"`
+	Qts    int   `gorm:"not null"`
+	Date   int   `gorm:"not null"`
+	Seq    int   `gorm:"not null"`
+}
+
+// ChannelUpdateState is the update sequence of one channel.
+type ChannelUpdateState struct {
+	UserID    int64 `gorm:"primaryKey;autoIncrement:false"`
+	ChannelID int64 `gorm:"primaryKey;autoIncrement:false"`
+	Pts       int   `gorm:"not null"`
+}
+
+// ChannelAccessHash is the access hash of a channel the account receives
+// updates from, needed to fetch the channel's missed updates.
+type ChannelAccessHash struct {
+	UserID     int64 `gorm:"primaryKey;autoIncrement:false"`
+	ChannelID  int64 `gorm:"primaryKey;autoIncrement:false"`
+	AccessHash int64 `gorm:"not null"`
+}
+
 type TelegramSession struct {
 	ID   uint   `gorm:"primaryKey"`
 	Data []byte `gorm:"type:bytea;not null"`
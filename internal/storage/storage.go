@@ -11,7 +11,54 @@ func NewStorage(db *gorm.DB) *Storage {
 }
 
 func (s *Storage) AutoMigrate() error {
-	return s.db.AutoMigrate(&ForwardRule{}, &ForwardLog{}, &TelegramSession{})
+	if err := s.db.AutoMigrate(&ForwardRule{}, &ForwardTarget{}, &ForwardLog{}, &OutboxItem{}, &MessageMapping{}, &BackfillJob{}, &DigestEntry{},
+		&UpdateState{}, &ChannelUpdateState{}, &ChannelAccessHash{}, &TelegramSession{}); err != nil {
+		return err
+	}
+	if err := s.migrateRuleTargets(); err != nil {
+		return err
+	}
+	return s.migrateRateLimits()
 }
 
 func (s *Storage) GetDB() *gorm.DB { return s.db }
+
+// migrateRuleTargets moves the single target of rules created before
+// multi-target support into forward_targets and links existing forward logs
+// to the new target rows.
+func (s *Storage) migrateRuleTargets() error {
+	if !s.db.Migrator().HasColumn("forward_rules", "target_channel_id") {
+		return nil
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`INSERT INTO forward_targets (rule_id, target_channel_id, target_name, target_hash, created_at)
+			SELECT id, target_channel_id, target_name, target_hash, created_at FROM forward_rules`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`UPDATE forward_logs l SET target_id = t.id FROM forward_targets t
+			WHERE l.target_id = 0 AND t.rule_id = l.rule_id AND t.target_channel_id = l.target_channel_id`).Error; err != nil {
+			return err
+		}
+
+		m := tx.Migrator()
+		if m.HasIndex("forward_logs", "idx_rule_msg") {
+			if err := m.DropIndex("forward_logs", "idx_rule_msg"); err != nil {
+				return err
+			}
+		}
+		for _, column := range []string{"target_channel_id", "target_name", "target_hash"} {
+			if err := m.DropColumn("forward_rules", column); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateRateLimits gives rules created before configurable rate limits the
+// previously hard-coded limit of one forward per minute.
+func (s *Storage) migrateRateLimits() error {
+	return s.db.Exec(`UPDATE forward_rules SET rate_limit = 1, rate_period = 60, rate_burst = 1
+		WHERE rate_period IS NULL`).Error
+}
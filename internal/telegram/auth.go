@@ -90,6 +90,7 @@ func (s *Service) VerifyCode(ctx context.Context, code string) (*VerifyCodeResul
 		return nil, err
 	}
 
+	s.setAuthorized()
 	return &VerifyCodeResult{Authorized: true, PasswordNeeded: false}, nil
 }
 
@@ -104,5 +105,6 @@ func (s *Service) SendPassword(ctx context.Context, password string) (*SendPassw
 	if err != nil {
 		return nil, err
 	}
+	s.setAuthorized()
 	return &SendPasswordResult{Authorized: true}, nil
 }
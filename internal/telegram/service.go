@@ -7,6 +7,8 @@ import (
 
 	"github.com/gotd/td/session"
 	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/updates"
+	updhook "github.com/gotd/td/telegram/updates/hook"
 	"github.com/gotd/td/tg"
 	"github.com/rs/zerolog/log"
 )
@@ -14,51 +16,61 @@ import (
 // UpdateHandler is the interface the forwarder engine implements.
 type UpdateHandler interface {
 	Handle(ctx context.Context, updates tg.UpdatesClass) error
+	// Sent is given the updates returned by the client's own requests
+	// before they are dispatched to Handle.
+	Sent(updates tg.UpdatesClass)
 }
 
 type Service struct {
 	appID          int
 	appHash        string
 	sessionStorage session.Storage
+	updateStorage  UpdateStorage
 	handler        UpdateHandler
 
-	client *telegram.Client
-	api    *tg.Client
-	ready  chan struct{}
-	cancel context.CancelFunc
+	client     *telegram.Client
+	api        *tg.Client
+	ready      chan struct{}
+	authorized chan struct{} // closed once a user is logged in
+	authOnce   sync.Once
+	cancel     context.CancelFunc
 
 	mu           sync.Mutex
 	authPhone    string
 	authCodeHash string
 }
 
-func NewService(appID int, appHash string, sessionStorage session.Storage, handler UpdateHandler) *Service {
+func NewService(appID int, appHash string, sessionStorage session.Storage, updateStorage UpdateStorage, handler UpdateHandler) *Service {
 	return &Service{
 		appID:          appID,
 		appHash:        appHash,
 		sessionStorage: sessionStorage,
+		updateStorage:  updateStorage,
 		handler:        handler,
 		ready:          make(chan struct{}),
+		authorized:     make(chan struct{}),
 	}
 }
 
 // Start creates the Telegram client and runs it. Blocks until ctx is cancelled.
+//
+// Updates pass through gotd's updates manager, which keeps the account's
+// update state in the update storage. After a restart or reconnect it
+// fetches what was missed with getDifference and hands it to the handler
+// like live updates; the forward log keeps messages from being delivered
+// twice.
 func (s *Service) Start(ctx context.Context) error {
 	ctx, s.cancel = context.WithCancel(ctx)
-
-	dispatcher := tg.NewUpdateDispatcher()
-	dispatcher.OnNewChannelMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateNewChannelMessage) error {
-		if s.handler != nil {
-			return s.handler.Handle(ctx, &tg.Updates{
-				Updates: []tg.UpdateClass{update},
-			})
-		}
-		return nil
-	})
+	gaps := s.updateManager()
 
 	s.client = telegram.NewClient(s.appID, s.appHash, telegram.Options{
 		SessionStorage: s.sessionStorage,
-		UpdateHandler:  dispatcher,
+		UpdateHandler:  gaps,
+		// Updates returned by our own requests carry pts too
+		Middlewares: []telegram.Middleware{updhook.UpdateHook(func(ctx context.Context, u tg.UpdatesClass) error {
+			s.handler.Sent(u)
+			return gaps.Handle(ctx, u)
+		})},
 		Device: telegram.DeviceConfig{
 			DeviceModel:    "tg-manager",
 			SystemVersion:  runtime.GOOS + "/" + runtime.GOARCH,
@@ -72,9 +84,99 @@ func (s *Service) Start(ctx context.Context) error {
 		s.api = s.client.API()
 		close(s.ready)
 		log.Info().Msg("Telegram client ready")
-		<-ctx.Done()
-		return ctx.Err()
+
+		userID, err := s.waitForAuth(ctx)
+		if err != nil {
+			return err
+		}
+		log.Info().Int64("user_id", userID).Msg("Tracking update state")
+		return gaps.Run(ctx, s.api, userID, updates.AuthOptions{})
+	})
+}
+
+// updateManager builds the updates manager that passes new, edited and
+// deleted messages to the handler. Once running, it converts the short
+// updates Telegram uses for most private and basic group messages into
+// UpdateNewMessage, which the dispatcher would otherwise drop.
+func (s *Service) updateManager() *updates.Manager {
+	dispatcher := tg.NewUpdateDispatcher()
+	dispatcher.OnNewChannelMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateNewChannelMessage) error {
+		return s.handle(ctx, e, update)
+	})
+	dispatcher.OnNewMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateNewMessage) error {
+		return s.handle(ctx, e, update)
+	})
+	dispatcher.OnEditChannelMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateEditChannelMessage) error {
+		return s.handle(ctx, e, update)
 	})
+	dispatcher.OnEditMessage(func(ctx context.Context, e tg.Entities, update *tg.UpdateEditMessage) error {
+		return s.handle(ctx, e, update)
+	})
+	dispatcher.OnDeleteChannelMessages(func(ctx context.Context, e tg.Entities, update *tg.UpdateDeleteChannelMessages) error {
+		return s.handle(ctx, e, update)
+	})
+	dispatcher.OnDeleteMessages(func(ctx context.Context, e tg.Entities, update *tg.UpdateDeleteMessages) error {
+		return s.handle(ctx, e, update)
+	})
+
+	return updates.New(updates.Config{
+		Handler:      dispatcher,
+		Storage:      s.updateStorage,
+		AccessHasher: s.updateStorage,
+		OnChannelTooLong: func(channelID int64) {
+			log.Warn().Int64("channel_id", channelID).Msg("Too many missed updates in channel, some were skipped")
+		},
+	})
+}
+
+// waitForAuth returns the ID of the logged-in user, waiting for a login
+// through the auth methods if there is none yet.
+func (s *Service) waitForAuth(ctx context.Context) (int64, error) {
+	status, err := s.client.Auth().Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if status.Authorized {
+		s.setAuthorized()
+		return status.User.ID, nil
+	}
+
+	select {
+	case <-s.authorized:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	self, err := s.client.Self(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return self.ID, nil
+}
+
+func (s *Service) setAuthorized() {
+	s.authOnce.Do(func() { close(s.authorized) })
+}
+
+// handle passes a single update to the handler, together with the users and
+// chats it references.
+func (s *Service) handle(ctx context.Context, e tg.Entities, update tg.UpdateClass) error {
+	if s.handler == nil {
+		return nil
+	}
+
+	updates := &tg.Updates{
+		Updates: []tg.UpdateClass{update},
+	}
+	for _, u := range e.Users {
+		updates.Users = append(updates.Users, u)
+	}
+	for _, c := range e.Chats {
+		updates.Chats = append(updates.Chats, c)
+	}
+	for _, c := range e.Channels {
+		updates.Chats = append(updates.Chats, c)
+	}
+	return s.handler.Handle(ctx, updates)
 }
 
 // Stop cancels the Telegram client context.
@@ -0,0 +1,86 @@
+package telegram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/telegram/updates"
+	"github.com/gotd/td/tg"
+)
+
+// stateAPI is an account with no missed updates.
+type stateAPI struct{}
+
+func (stateAPI) UpdatesGetState(ctx context.Context) (*tg.UpdatesState, error) {
+	return &tg.UpdatesState{Pts: 1, Date: int(time.Now().Unix())}, nil
+}
+
+func (stateAPI) UpdatesGetDifference(ctx context.Context, _ *tg.UpdatesGetDifferenceRequest) (tg.UpdatesDifferenceClass, error) {
+	return &tg.UpdatesDifferenceEmpty{Date: int(time.Now().Unix())}, nil
+}
+
+func (stateAPI) UpdatesGetChannelDifference(ctx context.Context, _ *tg.UpdatesGetChannelDifferenceRequest) (tg.UpdatesChannelDifferenceClass, error) {
+	return nil, context.Canceled
+}
+
+// handlerFunc passes handled updates on to a func.
+type handlerFunc func(updates tg.UpdatesClass)
+
+func (f handlerFunc) Handle(ctx context.Context, updates tg.UpdatesClass) error {
+	f(updates)
+	return nil
+}
+
+func (handlerFunc) Sent(tg.UpdatesClass) {}
+
+func TestShortMessagesReachHandler(t *testing.T) {
+	now := int(time.Now().Unix())
+	tests := []struct {
+		name   string
+		update tg.UpdatesClass
+		peer   tg.PeerClass
+	}{
+		{
+			name:   "private chat",
+			update: &tg.UpdateShortMessage{ID: 10, UserID: 5, Message: "hi", Pts: 2, PtsCount: 1, Date: now},
+			peer:   &tg.PeerUser{UserID: 5},
+		},
+		{
+			name:   "basic group",
+			update: &tg.UpdateShortChatMessage{ID: 10, FromID: 5, ChatID: 7, Message: "hi", Pts: 2, PtsCount: 1, Date: now},
+			peer:   &tg.PeerChat{ChatID: 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(chan *tg.Message, 1)
+			s := NewService(0, "", nil, nil, handlerFunc(func(u tg.UpdatesClass) {
+				for _, update := range u.(*tg.Updates).Updates {
+					if nm, ok := update.(*tg.UpdateNewMessage); ok {
+						got <- nm.Message.(*tg.Message)
+					}
+				}
+			}))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			gaps := s.updateManager()
+			started := make(chan struct{})
+			go gaps.Run(ctx, stateAPI{}, 1, updates.AuthOptions{OnStart: func(context.Context) { close(started) }})
+			<-started
+
+			if err := gaps.Handle(ctx, tt.update); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case msg := <-got:
+				if msg.ID != 10 || msg.Message != "hi" || msg.PeerID.String() != tt.peer.String() {
+					t.Fatalf("handled message %d %q in %v, want 10 \"hi\" in %v", msg.ID, msg.Message, msg.PeerID, tt.peer)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("short message did not reach the handler")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gotd/td/telegram/updates"
+	"github.com/tg-manager/internal/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UpdateStorage persists the update state the updates manager uses to
+// recover gaps.
+type UpdateStorage interface {
+	updates.StateStorage
+	updates.ChannelAccessHasher
+}
+
+// PostgresUpdateStorage keeps the update state of the account and its
+// channels in Postgres, so updates missed while offline are fetched with
+// getDifference after a restart.
+type PostgresUpdateStorage struct {
+	db *gorm.DB
+}
+
+var _ UpdateStorage = (*PostgresUpdateStorage)(nil)
+
+func NewPostgresUpdateStorage(db *gorm.DB) *PostgresUpdateStorage {
+	return &PostgresUpdateStorage{db: db}
+}
+
+func (s *PostgresUpdateStorage) GetState(ctx context.Context, userID int64) (updates.State, bool, error) {
+	var st storage.UpdateState
+	if err := s.db.WithContext(ctx).First(&st, "user_id = ?", userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return updates.State{}, false, nil
+		}
+		return updates.State{}, false, err
+	}
+	return updates.State{Pts: st.Pts, Qts: st.Qts, Date: st.Date, Seq: st.Seq}, true, nil
+}
+
+// SetState replaces the account's state. Channel states belong to the old
+// state and are dropped.
+func (s *PostgresUpdateStorage) SetState(ctx context.Context, userID int64, state updates.State) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		st := storage.UpdateState{UserID: userID, Pts: state.Pts, Qts: state.Qts, Date: state.Date, Seq: state.Seq}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&st).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&storage.ChannelUpdateState{}).Error
+	})
+}
+
+func (s *PostgresUpdateStorage) SetPts(ctx context.Context, userID int64, pts int) error {
+	return s.updateState(ctx, userID, map[string]interface{}{"pts": pts})
+}
+
+func (s *PostgresUpdateStorage) SetQts(ctx context.Context, userID int64, qts int) error {
+	return s.updateState(ctx, userID, map[string]interface{}{"qts": qts})
+}
+
+func (s *PostgresUpdateStorage) SetDate(ctx context.Context, userID int64, date int) error {
+	return s.updateState(ctx, userID, map[string]interface{}{"date": date})
+}
+
+func (s *PostgresUpdateStorage) SetSeq(ctx context.Context, userID int64, seq int) error {
+	return s.updateState(ctx, userID, map[string]interface{}{"seq": seq})
+}
+
+func (s *PostgresUpdateStorage) SetDateSeq(ctx context.Context, userID int64, date, seq int) error {
+	return s.updateState(ctx, userID, map[string]interface{}{"date": date, "seq": seq})
+}
+
+// updateState changes fields of an existing state; the updates manager
+// expects an error when there is none.
+func (s *PostgresUpdateStorage) updateState(ctx context.Context, userID int64, fields map[string]interface{}) error {
+	res := s.db.WithContext(ctx).Model(&storage.UpdateState{}).Where("user_id = ?", userID).Updates(fields)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("update state of user %d not found", userID)
+	}
+	return nil
+}
+
+func (s *PostgresUpdateStorage) GetChannelPts(ctx context.Context, userID, channelID int64) (int, bool, error) {
+	var st storage.ChannelUpdateState
+	err := s.db.WithContext(ctx).First(&st, "user_id = ? AND channel_id = ?", userID, channelID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return st.Pts, true, nil
+}
+
+func (s *PostgresUpdateStorage) SetChannelPts(ctx context.Context, userID, channelID int64, pts int) error {
+	st := storage.ChannelUpdateState{UserID: userID, ChannelID: channelID, Pts: pts}
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&st).Error
+}
+
+func (s *PostgresUpdateStorage) ForEachChannels(ctx context.Context, userID int64, f func(ctx context.Context, channelID int64, pts int) error) error {
+	var states []storage.ChannelUpdateState
+	if err := s.db.WithContext(ctx).Where("user_id = ?", userID).Find(&states).Error; err != nil {
+		return err
+	}
+	for _, st := range states {
+		if err := f(ctx, st.ChannelID, st.Pts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PostgresUpdateStorage) SetChannelAccessHash(ctx context.Context, userID, channelID, accessHash int64) error {
+	h := storage.ChannelAccessHash{UserID: userID, ChannelID: channelID, AccessHash: accessHash}
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&h).Error
+}
+
+func (s *PostgresUpdateStorage) GetChannelAccessHash(ctx context.Context, userID, channelID int64) (int64, bool, error) {
+	var h storage.ChannelAccessHash
+	err := s.db.WithContext(ctx).First(&h, "user_id = ? AND channel_id = ?", userID, channelID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return h.AccessHash, true, nil
+}